@@ -0,0 +1,84 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Rule file format converter
+ *
+ * 规则配置文件格式转换工具：方括号格式 <-> json 格式
+ * 用法：koala_ruleconv -i conf/koala_rule.conf -o conf/koala_rule.json
+ *       koala_ruleconv -i conf/koala_rule.json -o conf/koala_rule.conf
+ * 说明：默认按输入文件扩展名决定转换方向（.json 转为方括号格式，其余转为 json），可用 -to 指定
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/heiyeluren/koala/rulefmt"
+)
+
+func main() {
+	var in, out, to string
+	flag.StringVar(&in, "i", "", "input rule file")
+	flag.StringVar(&out, "o", "", "output rule file, default stdout")
+	flag.StringVar(&to, "to", "", "output format: json or bracket, default by input file extension")
+	flag.Parse()
+	if in == "" {
+		fmt.Fprintln(os.Stderr, "usage: ./koala_ruleconv -i conf/koala_rule.conf [-o conf/koala_rule.json] [-to json|bracket]")
+		os.Exit(2)
+	}
+	if to == "" {
+		to = "json"
+		if rulefmt.IsJSONFile(in) {
+			to = "bracket"
+		}
+	}
+
+	stream, err := ioutil.ReadFile(in)
+	if err != nil {
+		fail(err)
+	}
+	var ruleFile *rulefmt.File
+	if rulefmt.IsJSONFile(in) {
+		ruleFile, err = rulefmt.ParseJSON(stream)
+	} else {
+		ruleFile, err = rulefmt.ParseBracket(stream)
+	}
+	if err != nil {
+		fail(err)
+	}
+
+	var result []byte
+	switch to {
+	case "json":
+		if result, err = ruleFile.JSON(); err != nil {
+			fail(err)
+		}
+	case "bracket":
+		result = ruleFile.Bracket()
+	default:
+		fail(fmt.Errorf("unknown output format: %s", to))
+	}
+
+	if out == "" {
+		os.Stdout.Write(result)
+		return
+	}
+	if err = ioutil.WriteFile(out, result, 0644); err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err.Error())
+	os.Exit(1)
+}
@@ -33,9 +33,18 @@ func main() {
 	// 启动 规则更新协程，定期检查 policy 更新
 	go koala.PolicyLoader()
 
+	// 启动 预留超时处理协程，退还超时未 commit/cancel 的预留
+	go koala.ReserveAgent()
+
 	// 启动 http监听协程
 	go koala.FrontListen()
 
+	// 启动 rpc独立端口监听协程（未配置 rpc_listen 时直接返回）
+	go koala.RpcListen()
+
+	// 启动 redis协议监听协程（未配置 resp_listen 时直接返回）
+	go koala.RespListen()
+
 	// hold 住 main协程
 	select {}
 }
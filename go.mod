@@ -2,4 +2,7 @@ module github.com/heiyeluren/koala
 
 go 1.16
 
-require github.com/gomodule/redigo v1.8.9-0.20220324232115-5b789c6cfe82
+require (
+	github.com/alicebob/miniredis/v2 v2.30.0
+	github.com/gomodule/redigo v1.8.9-0.20220324232115-5b789c6cfe82
+)
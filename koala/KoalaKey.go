@@ -14,6 +14,7 @@ package koala
 
 import (
 	"errors"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -37,12 +38,14 @@ type KoalaKey interface {
 // GroupKey 集合 key 类型；满足 KoalaKey interface
 type GroupKey struct {
 	set     map[string]string
-	inverse bool // 取反标记；@,!@
-	combine bool // 合并标记；{~}
+	dict    string // 引用的词表名；@
+	inverse bool   // 取反标记；@,!@
+	combine bool   // 合并标记；{~}
 }
 
 /**
  * dump()
+ * 词表集合只输出词表名；元素按字典序输出，保证同一配置 dump 结果一致
  */
 func (g *GroupKey) dump() string {
 	ret := ""
@@ -52,7 +55,15 @@ func (g *GroupKey) dump() string {
 	if g.combine {
 		ret += "~"
 	}
+	if g.dict != "" {
+		return ret + "@" + g.dict
+	}
+	items := make([]string, 0, len(g.set))
 	for v := range g.set {
+		items = append(items, v)
+	}
+	sort.Strings(items)
+	for _, v := range items {
 		ret += v + ","
 	}
 	return ret
@@ -66,13 +77,10 @@ func (g *GroupKey) build(sp, k, v string) error {
 	g.set = make(map[string]string, 10)
 	g.combine = false
 	g.inverse = strings.HasSuffix(k, "!")
-	var isPresent bool
 	v = strings.Trim(v, emptyRunes)
 	if sp == "@" {
-		g.set, isPresent = TempPolicy.dictsTable[v]
-		if !isPresent {
-			return errors.New("rule build error: Dict not present")
-		}
+		// 词表内容由 bindDict() 从所属策略中取得
+		g.dict = v
 		return nil
 	}
 	if sp == "=" {
@@ -87,6 +95,19 @@ func (g *GroupKey) build(sp, k, v string) error {
 	return nil
 }
 
+/**
+ * bindDict()
+ * @ 语句引用的词表，从 dicts 中取得集合
+ */
+func (g *GroupKey) bindDict(dicts map[string]map[string]string) error {
+	set, isPresent := dicts[g.dict]
+	if !isPresent {
+		return errors.New("rule build error: Dict not present")
+	}
+	g.set = set
+	return nil
+}
+
 /**
  * matches()
  */
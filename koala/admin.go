@@ -12,37 +12,362 @@
 
 package koala
 
-/*
 import (
-    "fmt"
-    "io/ioutil"
-    "os"
-    "github.com/heiyeluren/koala/utility"
+	"crypto/subtle"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heiyeluren/koala/utility"
 )
 
-暂时删除
-func (s *FrontServer) DoRuleRewrite(request *network.HttpRequest, response *network.HttpResponse, logHandle *logger.Logger) {
-    ext_stream := request.Pstr("rule_stream")
-    if ext_stream == "" {
-        response.Puts(`{"errno": -1, "errmsg": "no rule stream"}`)
-        response.SetCode(400)
-        return
-    }
-    err := PolicyInterpreter(ext_stream)
-    if err != nil {
-        logHandle.Warning("[errmsg=" + err.Error() + "]")
-        response.Puts(`{"errno": -2, "errmsg": "rule format error! ;` + err.Error() + `"}`)
-        response.SetCode(400)
-        return
-    }
-    err = ioutil.WriteFile(Config.Get("rule_file"), []byte(ext_stream), os.FileMode.Perm(777))
-    if err != nil {
-        logHandle.Warning("[errmsg=" + err.Error() + "]")
-    }
-    response.Puts(`{"errno": 0, "errmsg": "rule rewrite success!"}`)
-    response.SetCode(200)
+// adminResult admin 接口统一返回结构
+type adminResult struct {
+	Errno  int         `json:"errno"`
+	Errmsg string      `json:"errmsg"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+// ruleRewriteResult 规则改写接口的返回数据
+type ruleRewriteResult struct {
+	ValidateOnly bool        `json:"validate_only"`
+	Version      int64       `json:"version,omitempty"`
+	Md5          string      `json:"md5,omitempty"`
+	Diff         *PolicyDiff `json:"diff"`
+}
+
+// policyDiffResult 策略差异接口的返回数据；From 为 0 表示首次加载
+// Diff 含 rule 原文和词表条目，只在 admin_token 认证后返回
+type policyDiffResult struct {
+	From  int64            `json:"from"`
+	To    int64            `json:"to"`
+	Count *PolicyDiffCount `json:"count"`
+	Diff  *PolicyDiff      `json:"diff,omitempty"`
+}
+
+/**
+ * 组装差异接口的返回数据；withDiff 为 false 时只返回数量统计
+ */
+func newPolicyDiffResult(from, to int64, diff *PolicyDiff, withDiff bool) policyDiffResult {
+	result := policyDiffResult{From: from, To: to, Count: diff.Count()}
+	if withDiff {
+		result.Diff = diff
+	}
+	return result
+}
+
+// policyServingInfo 实例正在使用的策略信息
+type policyServingInfo struct {
+	Instance     string `json:"instance"`
+	Source       string `json:"source"`
+	RedisVersion string `json:"redis_version,omitempty"`
+	Version      int64  `json:"version"`
+	Md5          string `json:"md5"`
+}
+
+// policyVersionInfo 策略版本信息
+type policyVersionInfo struct {
+	Version  int64  `json:"version"`
+	Md5      string `json:"md5"`
+	Origin   string `json:"origin"`
+	LoadTime string `json:"load_time"`
+	Current  bool   `json:"current"`
+	Rules    int    `json:"rules"`
+	Source   string `json:"source,omitempty"`
+}
+
+/**
+ * admin 接口输出 json 结果
+ */
+func adminResponse(response *utility.HttpResponse, code int, errno int, errmsg string, data interface{}) {
+	retString, err := json.Marshal(adminResult{Errno: errno, Errmsg: errmsg, Data: data})
+	if err != nil {
+		response.SetCode(500)
+		return
+	}
+	response.Puts(string(retString))
+	response.SetCode(code)
+}
+
+/**
+ * admin 改写类接口、规则原文查看的 token 认证
+ * token 通过 X-Koala-Token 头或 _token 参数传入；未配置 admin_token 时，一律拒绝
+ */
+func adminAuth(request *utility.HttpRequest) bool {
+	token := Config.Get("admin_token")
+	if token == "" {
+		return false
+	}
+	given := request.Header("X-Koala-Token")
+	if given == "" {
+		given = request.Rstr("_token")
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+/**
+ * 组装版本信息；withSource 为 true 时附带规则原文
+ */
+func newPolicyVersionInfo(v *PolicyVersion, current int64, withSource bool) policyVersionInfo {
+	info := policyVersionInfo{
+		Version:  v.Version,
+		Md5:      v.Md5,
+		Origin:   v.Origin,
+		LoadTime: v.LoadTime.Format(time.RFC3339),
+		Current:  v.Version == current,
+		Rules:    len(v.policy.ruleTable),
+	}
+	if withSource {
+		info.Source = v.Source
+	}
+	return info
+}
+
+// DoPolicyHistory 策略版本历史查看接口
+// 参数：version 指定版本号时，只返回该版本（含规则原文）；source=yes 时全部版本附带规则原文
+// 说明：返回规则原文时需 admin_token 认证
+func (s *FrontServer) DoPolicyHistory(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) {
+	version := int64(request.Rint("version"))
+	withSource := version != 0 || request.Rstr("source") == "yes"
+	// 规则原文可能包含名单等敏感配置，与改写类接口一样需要认证
+	if withSource && !adminAuth(request) {
+		adminResponse(response, 403, -3, "permission denied", nil)
+		return
+	}
+	versions, current := PolicyVersions.List()
+
+	if version != 0 {
+		v, OK := PolicyVersions.Get(version)
+		if !OK {
+			adminResponse(response, 400, -1, "policy version not found", nil)
+			return
+		}
+		adminResponse(response, 200, 0, "OK", newPolicyVersionInfo(v, current, true))
+		return
+	}
+
+	infos := make([]policyVersionInfo, 0, len(versions))
+	for _, v := range versions {
+		infos = append(infos, newPolicyVersionInfo(v, current, withSource))
+	}
+	adminResponse(response, 200, 0, "OK", infos)
+}
+
+// DoPolicyDiff 策略差异查看接口
+// 参数：version 查看该版本加载时相对于之前正在使用策略的变化，缺省为当前版本；
+// 同时指定 from、to 时，比较历史中的任意两个版本
+// 说明：rule 原文、词表条目需 admin_token 认证，未认证时只返回变化的数量
+func (s *FrontServer) DoPolicyDiff(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) {
+	// 词表条目可能是名单等敏感配置，与 /policy/history 的规则原文一样需要认证
+	withDiff := adminAuth(request)
+	from, to := int64(request.Rint("from")), int64(request.Rint("to"))
+	if from != 0 || to != 0 {
+		fromVersion, fromOK := PolicyVersions.Get(from)
+		toVersion, toOK := PolicyVersions.Get(to)
+		if !fromOK || !toOK {
+			adminResponse(response, 400, -1, "policy version not found", nil)
+			return
+		}
+		adminResponse(response, 200, 0, "OK", newPolicyDiffResult(from, to, DiffPolicy(fromVersion.policy, toVersion.policy), withDiff))
+		return
+	}
+
+	version := int64(request.Rint("version"))
+	if version == 0 {
+		_, version = PolicyVersions.List()
+	}
+	v, OK := PolicyVersions.Get(version)
+	if !OK {
+		adminResponse(response, 400, -1, "policy version not found", nil)
+		return
+	}
+	// 首次加载的版本没有记录差异，相对于空策略计算
+	diff := v.diff
+	if diff == nil {
+		diff = DiffPolicy(nil, v.policy)
+	}
+	adminResponse(response, 200, 0, "OK", newPolicyDiffResult(v.previous, v.Version, diff, withDiff))
+}
+
+// DoPolicyVersion 查看本实例正在使用的策略版本
+func (s *FrontServer) DoPolicyVersion(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) {
+	policyLoadLock.Lock()
+	info := policyServingInfo{
+		Instance:     policyInstanceID(),
+		Source:       policySourceFile,
+		RedisVersion: PolicyRedisVersion,
+		Md5:          PolicyMd5,
+	}
+	policyLoadLock.Unlock()
+	if policySourceIsRedis() {
+		info.Source = policySourceRedis
+	}
+	_, info.Version = PolicyVersions.List()
+	adminResponse(response, 200, 0, "OK", info)
+}
+
+// DoPolicyRollback 策略回滚接口，将内存中的策略回滚到指定版本，不改动规则文件
+// 说明：策略来源为 redis 时不支持本地回滚
+func (s *FrontServer) DoPolicyRollback(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) {
+	if !adminAuth(request) {
+		adminResponse(response, 403, -3, "permission denied", nil)
+		return
+	}
+	version := int64(request.Rint("version"))
+	if version == 0 {
+		adminResponse(response, 400, -1, "no version", nil)
+		return
+	}
+	// 策略来源为 redis 时，本地回滚会与 redis 版本不一致，且下次轮询不会纠正；应在 redis 中重新发布旧版本
+	if policySourceIsRedis() {
+		adminResponse(response, 400, -5, "policy source is redis, publish the old version to redis instead", nil)
+		return
+	}
+	policyLoadLock.Lock()
+	defer policyLoadLock.Unlock()
+	previous := CurrentPolicy()
+	v, err := PolicyVersions.Rollback(version)
+	if err != nil {
+		logHandle.Warning("[errmsg=" + err.Error() + " version=" + strconv.FormatInt(version, 10) + "]")
+		adminResponse(response, 400, -2, err.Error(), nil)
+		return
+	}
+	logHandle.Trace("[msg=policy rollback! version=" + strconv.FormatInt(v.Version, 10) + " md5=" + v.Md5 + "]")
+	policyDiffTrace(v, DiffPolicy(previous, v.policy), "rollback", logHandle)
+	_, current := PolicyVersions.List()
+	adminResponse(response, 200, 0, "OK", newPolicyVersionInfo(v, current, false))
+}
+
+// DoRuleRewrite 规则改写接口
+// 参数：rule_stream（POST）完整的规则配置；validate_only=yes 时只做校验和 diff，不落盘、不生效
+// 说明：校验通过后，先写入临时文件再 rename 覆盖 rule_file，随即替换内存中的策略，返回 rule 变化
+func (s *FrontServer) DoRuleRewrite(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) {
+	if !adminAuth(request) {
+		adminResponse(response, 403, -3, "permission denied", nil)
+		return
+	}
+	extStream := request.Pstr("rule_stream")
+	if extStream == "" {
+		adminResponse(response, 400, -1, "no rule stream", nil)
+		return
+	}
+	validateOnly := request.Rstr("validate_only") == "yes"
+
+	policy, err := PolicyParse(extStream)
+	if err != nil {
+		logHandle.Warning("[errmsg=" + err.Error() + "]")
+		adminResponse(response, 400, -2, "rule format error! ;"+err.Error(), nil)
+		return
+	}
+
+	if validateOnly {
+		result := ruleRewriteResult{ValidateOnly: true, Diff: DiffPolicy(CurrentPolicy(), policy)}
+		adminResponse(response, 200, 0, "rule validate success!", result)
+		return
+	}
+	// 策略来源为 redis 时，本地规则文件不生效，只能通过 redis 发布新版本
+	if policySourceIsRedis() {
+		adminResponse(response, 400, -5, "policy source is redis, publish new version to redis instead", nil)
+		return
+	}
+
+	policyLoadLock.Lock()
+	defer policyLoadLock.Unlock()
+
+	result := ruleRewriteResult{Diff: DiffPolicy(CurrentPolicy(), policy)}
+	if err = WriteFileAtomic(Config.Get("rule_file"), []byte(extStream), 0644); err != nil {
+		logHandle.Fatal("[errmsg=" + err.Error() + "]")
+		adminResponse(response, 500, -4, "rule file write error! ;"+err.Error(), nil)
+		return
+	}
+
+	publishPolicy(policy)
+	PolicyMd5 = NewPolicyMD5()
+	version := PolicyVersions.Record(policy, PolicyMd5, policyOriginRewrite)
+	policyWatchSync(logHandle)
+	result.Version = version.Version
+	result.Md5 = version.Md5
+
+	logHandle.Trace("[msg=policy rewrite! new-md5=" + PolicyMd5 + " version=" + strconv.FormatInt(version.Version, 10) + "]")
+	policyDiffTrace(version, version.diff, "rewrite", logHandle)
+	adminResponse(response, 200, 0, "rule rewrite success!", result)
+}
+
+// ruleResetResult 单条 rule 的重置结果
+type ruleResetResult struct {
+	Return    int32    `json:"return"`
+	Method    string   `json:"method"`
+	CacheKeys []string `json:"cache_keys"`
+	Deleted   int      `json:"deleted"`
+	// Reservations 移除了这些 key 占用的未处理预留数
+	Reservations int    `json:"reservations,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// DoRuleReset 计数重置（解封）接口
+// 参数同 /rule/browse；rule_no 指定 rule 的 return 值，或 rule_no=all 表示全部匹配的 rule，二者必选其一
+// 说明：删除匹配 rule 的 count、base（含 _B 后缀）、leak 缓存 key，解除正在生效的限制；direct 规则（词表）不受影响
+// 同时从未处理的预留中移除这些 key 的占用，之后的 cancel、超时退还不会扣减重置后的计数
+// 每次调用记录审计日志
+func (s *FrontServer) DoRuleReset(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) {
+	if !adminAuth(request) {
+		adminResponse(response, 403, -3, "permission denied", nil)
+		return
+	}
+	ruleNo := request.Rstr("rule_no")
+	if ruleNo == "" {
+		adminResponse(response, 400, -1, "no rule_no, use rule_no=all for all rules", nil)
+		return
+	}
+	var returnCode int
+	if ruleNo != "all" {
+		var err error
+		if returnCode, err = strconv.Atoi(ruleNo); err != nil || returnCode <= 0 {
+			adminResponse(response, 400, -1, "invalid rule_no", nil)
+			return
+		}
+	}
+
+	// 本地策略指针，可避免匹配过程中Global策略被替换 导致不一致
+	var localPolicy = CurrentPolicy()
+
+	params := request.Params()
+	results := []ruleResetResult{}
+	for i := range localPolicy.ruleTable {
+		singleRule := &localPolicy.ruleTable[i]
+		if returnCode != 0 && singleRule.returnCode != int32(returnCode) {
+			continue
+		}
+		if singleRule.method == "direct" {
+			continue
+		}
+		if !singleRule.satisfied(params) {
+			continue
+		}
+		one := ruleResetResult{Return: singleRule.returnCode, Method: singleRule.method}
+		cacheKey := singleRule.getCacheKey(params)
+		keys, deleted, err := singleRule.reset(cacheKey)
+		one.CacheKeys, one.Deleted = keys, deleted
+		if err == nil {
+			one.Reservations, err = localPolicy.dropReservedKey(cacheKey)
+		}
+		if err != nil {
+			logHandle.Fatal("[errmsg=" + err.Error() + " return=" + strconv.Itoa(int(one.Return)) + "]")
+			one.Error = err.Error()
+		}
+		results = append(results, one)
+
+		logHandle.Notice("[msg=rule reset audit remote=" + request.GetRemoteIP() + " rule_no=" + ruleNo +
+			" return=" + strconv.Itoa(int(one.Return)) + " method=" + one.Method +
+			" cachekeys=" + strings.Join(one.CacheKeys, ",") + " deleted=" + strconv.Itoa(one.Deleted) + "]")
+	}
+	if len(results) == 0 {
+		logHandle.Notice("[msg=rule reset audit remote=" + request.GetRemoteIP() + " rule_no=" + ruleNo + " matched=0]")
+	}
+
+	adminResponse(response, 200, 0, "OK", results)
 }
-*/
 
 /*
 func (s *FrontServer) DoDumpCounter(request *network.HttpRequest, response *network.HttpResponse, logHandle *logger.Logger) {
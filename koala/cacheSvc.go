@@ -34,15 +34,25 @@ func InitRedisPool() {
 	var writeTimeout time.Duration = time.Duration(Config.GetInt("externalWriteTimeout")) * time.Millisecond
 
 	// 新建连接池
-	RedisPool = &redis.Pool{
+	RedisPool = newRedisPool(server, password, maxIdle, time.Duration(idleTimeout)*time.Second, connectTimeout, readTimeout, writeTimeout)
+}
+
+/**
+ * 新建 redis 连接池；password 为空时不做 AUTH
+ */
+func newRedisPool(server string, password string, maxIdle int, idleTimeout, connectTimeout, readTimeout, writeTimeout time.Duration) *redis.Pool {
+	return &redis.Pool{
 		MaxIdle:     maxIdle,
-		IdleTimeout: time.Duration(idleTimeout) * time.Second,
+		IdleTimeout: idleTimeout,
 		// dial方法
 		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", server, redis.DialConnectTimeout(connectTimeout), redis.DialReadTimeout(readTimeout), redis.DialReadTimeout(writeTimeout))
+			c, err := redis.Dial("tcp", server, redis.DialConnectTimeout(connectTimeout), redis.DialReadTimeout(readTimeout), redis.DialWriteTimeout(writeTimeout))
 			if err != nil {
 				return nil, err
 			}
+			if password == "" {
+				return c, nil
+			}
 			if _, err = c.Do("AUTH", password); err != nil {
 				c.Close()
 				return nil, err
@@ -0,0 +1,276 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Decision event stream
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koala
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/heiyeluren/koala/utility"
+)
+
+// DecisionEvent 判定事件，每条匹配的 rule 一个（event_level = deny 时只有超出限制的）
+// 以 NDJSON（每行一个 json）发送到 event_sink
+type DecisionEvent struct {
+	Time     int64             `json:"time"`   // 判定时间，unix 毫秒
+	Rule     int32             `json:"rule"`   // rule 的 return 值
+	Method   string            `json:"method"` // rule 类型
+	CacheKey string            `json:"cache_key,omitempty"`
+	Params   map[string]string `json:"params"` // rule 的 key 对应的参数，以及 event_params 配置的参数
+	Deny     bool              `json:"deny"`   // 是否超出限制
+	Result   int32             `json:"result"` // 超出限制时的 [result] 编号；未超出时为 1
+}
+
+// eventStats 判定事件计数；Dropped 为缓冲已满或发送失败而丢弃的事件数
+type eventStats struct {
+	Sink     string `json:"sink"`
+	Buffered int    `json:"buffered"`
+	Capacity int    `json:"capacity"`
+	Emitted  uint64 `json:"emitted"`
+	Written  uint64 `json:"written"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+// eventSink 事件的发送目标；stream 为若干行 json，每行以 \n 结尾
+type eventSink interface {
+	write(stream []byte) error
+}
+
+var (
+	// eventChan 事件缓冲；为空时不启用判定事件
+	eventChan     chan *DecisionEvent
+	eventDenyOnly bool
+	eventParams   []string
+	eventSinkName string
+
+	eventEmitted uint64
+	eventWritten uint64
+	eventDropped uint64
+)
+
+/**
+ * 按配置启动判定事件的发送协程；event_sink 为空时不启用
+ * 在 Run() 中、接口开始服务之前调用
+ */
+func startEventAgent() {
+	eventSinkName = Config.Get("event_sink")
+	if eventSinkName == "" {
+		return
+	}
+	timeout := time.Duration(Config.GetInt("event_timeout")) * time.Millisecond
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	sink, err := newEventSink(eventSinkName, timeout)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	bufferSize := Config.GetInt("event_buffer_size")
+	if bufferSize <= 0 {
+		bufferSize = 10240
+	}
+	batchSize := Config.GetInt("event_batch_size")
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	interval := time.Duration(Config.GetInt("event_flush_interval")) * time.Millisecond
+	if interval <= 0 {
+		interval = time.Second
+	}
+	eventDenyOnly = Config.Get("event_level") != "hit"
+	for _, param := range strings.Split(Config.Get("event_params"), ",") {
+		if param = strings.Trim(param, emptyRunes); param != "" {
+			eventParams = append(eventParams, param)
+		}
+	}
+	eventChan = make(chan *DecisionEvent, bufferSize)
+	go eventAgent(eventChan, sink, eventSinkName, batchSize, interval)
+}
+
+/**
+ * 根据 event_sink 配置创建发送目标：
+ * file:/path/to/events.log  追加写入文件
+ * tcp:host:port             每行一个事件写入 tcp 连接，断开后下次发送时重连
+ * http://... 或 https://... webhook，每批事件 POST 一次，Content-Type: application/x-ndjson
+ */
+func newEventSink(sink string, timeout time.Duration) (eventSink, error) {
+	switch {
+	case strings.HasPrefix(sink, "file:"):
+		file, err := os.OpenFile(strings.TrimPrefix(sink, "file:"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return &fileEventSink{file: file}, nil
+	case strings.HasPrefix(sink, "tcp:"):
+		return &tcpEventSink{address: strings.TrimPrefix(sink, "tcp:"), timeout: timeout}, nil
+	case strings.HasPrefix(sink, "http://"), strings.HasPrefix(sink, "https://"):
+		return &webhookEventSink{url: sink, client: &http.Client{Timeout: timeout}}, nil
+	}
+	return nil, errors.New("event_sink must be file:<path>, tcp:<host:port> or an http(s) url")
+}
+
+/**
+ * 发送判定事件；缓冲已满时丢弃并计数，不阻塞判定过程
+ */
+func emitDecisionEvent(rule *Rule, cacheKey string, params map[string]string, isOut bool) {
+	if eventChan == nil || (eventDenyOnly && !isOut) {
+		return
+	}
+	event := &DecisionEvent{
+		Time:     time.Now().UnixNano() / int64(time.Millisecond),
+		Rule:     rule.returnCode,
+		Method:   rule.method,
+		CacheKey: cacheKey,
+		Params:   make(map[string]string, len(rule.keys)+len(eventParams)),
+		Deny:     isOut,
+		Result:   1,
+	}
+	if isOut {
+		event.Result = rule.result
+	}
+	for name := range rule.keys {
+		event.Params[name] = params[name]
+	}
+	for _, name := range eventParams {
+		if value, OK := params[name]; OK {
+			event.Params[name] = value
+		}
+	}
+	atomic.AddUint64(&eventEmitted, 1)
+	select {
+	case eventChan <- event:
+	default:
+		atomic.AddUint64(&eventDropped, 1)
+	}
+}
+
+// recordDecision http 等前端接口的判定回调：记录策略统计，发送判定事件
+func recordDecision(rule *Rule, cacheKey string, params map[string]string, isOut bool) {
+	CounterClient(rule.returnCode, isOut)
+	emitDecisionEvent(rule, cacheKey, params, isOut)
+}
+
+/**
+ * 从缓冲 events 中取出事件，按 batchSize 或 interval 成批发送到 sink；发送失败的事件计入丢弃数
+ */
+func eventAgent(events <-chan *DecisionEvent, sink eventSink, sinkName string, batchSize int, interval time.Duration) {
+	logHandle := utility.NewLogger("")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var batch bytes.Buffer
+	var count int
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		if err := sink.write(batch.Bytes()); err != nil {
+			atomic.AddUint64(&eventDropped, uint64(count))
+			logHandle.Warning("[errmsg=decision event write failed, " + err.Error() + " sink=" + sinkName + "]")
+		} else {
+			atomic.AddUint64(&eventWritten, uint64(count))
+		}
+		batch.Reset()
+		count = 0
+	}
+	for {
+		select {
+		case event := <-events:
+			line, err := json.Marshal(event)
+			if err != nil {
+				atomic.AddUint64(&eventDropped, 1)
+				continue
+			}
+			batch.Write(line)
+			batch.WriteByte('\n')
+			if count++; count >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+/**
+ * 当前的判定事件计数
+ */
+func currentEventStats() eventStats {
+	return eventStats{
+		Sink:     eventSinkName,
+		Buffered: len(eventChan),
+		Capacity: cap(eventChan),
+		Emitted:  atomic.LoadUint64(&eventEmitted),
+		Written:  atomic.LoadUint64(&eventWritten),
+		Dropped:  atomic.LoadUint64(&eventDropped),
+	}
+}
+
+type fileEventSink struct {
+	file *os.File
+}
+
+func (s *fileEventSink) write(stream []byte) error {
+	_, err := s.file.Write(stream)
+	return err
+}
+
+type tcpEventSink struct {
+	address string
+	timeout time.Duration
+	conn    net.Conn
+}
+
+func (s *tcpEventSink) write(stream []byte) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.address, s.timeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	if _, err := s.conn.Write(stream); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+type webhookEventSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookEventSink) write(stream []byte) error {
+	response, err := s.client.Post(s.url, "application/x-ndjson", bytes.NewReader(stream))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	ioutil.ReadAll(response.Body)
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return errors.New("webhook response " + response.Status)
+	}
+	return nil
+}
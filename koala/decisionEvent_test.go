@@ -0,0 +1,152 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Decision event tests
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koala
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/heiyeluren/koala/utility"
+)
+
+/**
+ * 启用判定事件：缓冲长度为 size，只发送超出限制的事件；计数清零，测试结束时恢复
+ */
+func testEventBuffer(t *testing.T, size int) {
+	oldChan, oldDenyOnly, oldParams, oldSink := eventChan, eventDenyOnly, eventParams, eventSinkName
+	eventChan, eventDenyOnly, eventParams, eventSinkName = make(chan *DecisionEvent, size), true, []string{"ip"}, "test"
+	resetEventStats()
+	t.Cleanup(func() {
+		eventChan, eventDenyOnly, eventParams, eventSinkName = oldChan, oldDenyOnly, oldParams, oldSink
+		resetEventStats()
+	})
+}
+
+/**
+ * 计数清零；发送协程可能仍在运行，与它一样原子地写入
+ */
+func resetEventStats() {
+	for _, counter := range []*uint64{&eventEmitted, &eventWritten, &eventDropped} {
+		atomic.StoreUint64(counter, 0)
+	}
+}
+
+// testEventSink 记录写入的内容；fail 为 true 时写入失败
+type testEventSink struct {
+	mu      sync.Mutex
+	fail    bool
+	written bytes.Buffer
+}
+
+func (s *testEventSink) write(stream []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return errors.New("sink down")
+	}
+	s.written.Write(stream)
+	return nil
+}
+
+func TestEmitDecisionEventDrop(t *testing.T) {
+	testEventBuffer(t, 2)
+	policy, err := policyParseStream([]byte(testReserveRules), false, testDictReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := &policy.ruleTable[0]
+	params := map[string]string{"act": "ask", "uid": "10001", "ip": "192.0.2.1", "ua": "curl"}
+
+	// 未超出限制的不发送；缓冲已满时丢弃并计数
+	emitDecisionEvent(rule, "k", params, false)
+	for n := 0; n < 3; n++ {
+		emitDecisionEvent(rule, "k", params, true)
+	}
+	stats := currentEventStats()
+	want := eventStats{Sink: "test", Buffered: 2, Capacity: 2, Emitted: 3, Written: 0, Dropped: 1}
+	if stats != want {
+		t.Errorf("stats: want %+v, got %+v", want, stats)
+	}
+
+	event := <-eventChan
+	wantParams := map[string]string{"act": "ask", "uid": "10001", "ip": "192.0.2.1"}
+	if event.Rule != 201 || !event.Deny || event.Result != 2 || len(event.Params) != len(wantParams) {
+		t.Fatalf("event: got %+v", event)
+	}
+	for name, value := range wantParams {
+		if event.Params[name] != value {
+			t.Errorf("event param %s: want %q, got %q", name, value, event.Params[name])
+		}
+	}
+
+	// /monitor/events 返回同样的计数
+	response := utility.NewHttpResponse()
+	NewFrontServer().DoMonitorEvents(utility.NewHttpRequest(), response, utility.NewLogger(""))
+	var result struct {
+		Errno int        `json:"errno"`
+		Data  eventStats `json:"data"`
+	}
+	if err := json.Unmarshal(response.BodyStream(), &result); err != nil {
+		t.Fatalf("bad /monitor/events response %q: %v", response.BodyString(), err)
+	}
+	want.Buffered = 1
+	if response.Code() != 200 || result.Errno != 0 || result.Data != want {
+		t.Errorf("/monitor/events: want %+v, got %d %+v", want, response.Code(), result)
+	}
+}
+
+func TestEventAgent(t *testing.T) {
+	testEventBuffer(t, 10)
+	policy, err := policyParseStream([]byte(testReserveRules), false, testDictReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &testEventSink{}
+	go eventAgent(eventChan, sink, eventSinkName, 2, 10*time.Millisecond)
+
+	// 写入成功的计入 Written，失败的计入 Dropped
+	for n := 0; n < 3; n++ {
+		emitDecisionEvent(&policy.ruleTable[0], "k", map[string]string{"act": "ask", "uid": "10001"}, true)
+	}
+	waitEventStats(t, func(stats eventStats) bool { return stats.Written == 3 })
+	sink.mu.Lock()
+	lines := bytes.Count(sink.written.Bytes(), []byte("\n"))
+	sink.fail = true
+	sink.mu.Unlock()
+	if lines != 3 {
+		t.Errorf("want 3 lines written, got %d", lines)
+	}
+
+	emitDecisionEvent(&policy.ruleTable[0], "k", map[string]string{"act": "ask", "uid": "10001"}, true)
+	waitEventStats(t, func(stats eventStats) bool { return stats.Dropped == 1 })
+	if stats := currentEventStats(); stats.Emitted != 4 || stats.Written != 3 {
+		t.Errorf("stats after failed write: got %+v", stats)
+	}
+}
+
+/**
+ * 等待事件计数满足条件，最多 1 秒
+ */
+func waitEventStats(t *testing.T, done func(eventStats) bool) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if done(currentEventStats()) {
+			return
+		}
+	}
+	t.Fatalf("event stats: got %+v", currentEventStats())
+}
@@ -15,19 +15,85 @@ package koala
 /*
 线上提供接口列表
 
+参数可以通过 query string、表单（POST）或 application/json 请求体传入：
+单次调用为平铺的 json 对象，如 {"act":"add_comment","uid":123}；
+多重接口（/multi/browse、/multi/update）可直接传 json 数组，每个元素为一个 job 的参数对象，ID 字段为 job 标识
+
+以上接口也可以通过 gob rpc 长连接调用（utility.RpcConnection），与 http 共用 listen 端口，或使用 rpc_listen 独立端口；
+配置 rpc_listen 后 listen 端口默认不再识别 rpc（rpc_sniff = yes 可以保留），rpc_sniff = no 时 listen 端口只处理 http：
+RpcRequest.Func 为接口路径（如 rule/browse），Args 为参数；多重接口的 job 列表放在 Args["jobs"]（[]map[string]string）
+RpcResponse.Code 为 http 状态码，Data 为与 http 接口相同的 json 文本
+
+配置 resp_listen 后，可以用任意 redis 客户端调用（支持 pipeline）：
+KOALA.CHECK act ask uid 123        => /rule/browse
+KOALA.CHECKALL act ask uid 123     => /rule/browse_complete
+KOALA.UPDATE act ask uid 123       => /rule/update
+KOALA.MCHECK {"ID":"1","uid":"123"} {"ID":"2","uid":"456"}   => /multi/browse
+KOALA.MUPDATE {"ID":"1","uid":"123"}                         => /multi/update
+回复为接口返回的 json 文本；接口非 200 时为错误回复
+
+Go 程序也可以直接嵌入引擎，不需要配置文件和独立进程（见 engine.go）：
+engine, err := koala.NewEngine(koala.EngineOptions{RedisServer: "127.0.0.1:6379"}, ruleText)
+ret, err := engine.Browse(ctx, map[string]string{"act": "ask", "uid": "123"})
+Browse、BrowseAll、Update、MultiBrowse 分别对应 /rule/browse、/rule/browse_complete、/rule/update（同步）、/multi/browse
+
 查询接口(命中一条策略结果直接返回)
 /rule/browse
 
 完全查询接口(将所有命中的策略结果返回)
 /rule/browse_complete
 
+查询接口传 _quota=yes（或命中 quota_namespaces 配置）时，结果附带 Limit、Remaining、ResetAt、RetryAfter 限额信息
+
 多重查询接口
 /multi/browse
 
-更新接口
+判定过程解释接口(逐条 rule 给出匹配和判定情况，无副作用)
+/rule/explain
+
+缓存状态查询接口(每条匹配 rule 的缓存 key、计数值、剩余有效期，无副作用)
+/rule/value
+
+更新接口(默认异步；_sync=yes 时完成更新后返回每条 rule 的结果，有失败时 err_no 为 -1)
 /rule/update
 
+更新接口（含 /multi/update 的每个 job、_writeThrough）可带 _reqid：reqid_ttl 秒内同一 _reqid 对同一 rule 只计数一次，重试不会重复计数
+
+预留：查询接口传 _reserve=yes 时，判定的同时原子地占用额度（等同于查询 + 更新），未超出限制时结果附带 Reservation 预留 token；
+超出限制时不占用任何 rule 的额度。动作完成后以 reservation=<token> 调用 /rule/commit 保留占用，动作失败时调用 /rule/cancel 退还；
+reserve_timeout 秒内未 commit/cancel 的预留自动退还。已处理或已超时的预留返回 404；
+count、base 规则的计数窗口已轮换时不再退还（结果中 skipped 为 true）；缓存 key 被 /rule/reset 重置时，预留中这些 key 的占用一并移除
+/rule/commit
+/rule/cancel
+
+多重更新接口(参数同多重查询接口，返回每个 job 的更新结果)
+/multi/update
+
+行为反馈接口(按 rule 的 erase1/erase2 回退 leak、count 计数，不低于 0)
+/rule/feedback
+
 监控接口
 /monitor/alive
 
+判定事件计数接口(缓冲中、已发送、丢弃的事件数，见 event_sink 配置)
+/monitor/events
+
+策略版本历史接口（version、source=yes 返回规则原文，需 admin_token 认证）
+/policy/history
+
+当前使用的策略版本接口
+/policy/version
+
+策略差异接口（每次加载相对于之前策略的变化，或任意两个历史版本之间的变化；rule 原文、词表条目需 admin_token 认证，否则只返回变化数量）
+/policy/diff
+
+策略回滚接口（需 admin_token 认证；policy_source = redis 时不可用，应在 redis 中重新发布旧版本）
+/policy/rollback
+
+规则改写接口（需 admin_token 认证）
+/rule/rewrite
+
+计数重置（解封）接口（需 admin_token 认证，删除匹配 rule 的计数缓存，记录审计日志）
+/rule/reset
+
 */
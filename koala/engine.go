@@ -0,0 +1,148 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Embeddable engine api
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koala
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/heiyeluren/koala/utility"
+)
+
+// EngineOptions 嵌入式引擎配置；零值字段使用与 conf/koala.conf 相同的默认值
+type EngineOptions struct {
+	RedisServer      string        // redis 地址，默认 127.0.0.1:6379
+	RedisAuth        string        // redis 口令，为空时不做 AUTH
+	RedisMaxIdle     int           // 连接池最大空闲连接数，默认 5
+	RedisIdleTimeout time.Duration // 空闲连接超时，默认 300 秒
+	ConnectTimeout   time.Duration // 连接超时，默认 500 毫秒
+	ReadTimeout      time.Duration // 读超时，默认 500 毫秒
+	WriteTimeout     time.Duration // 写超时，默认 500 毫秒
+
+	// RedisPool 使用已有的连接池；设置后忽略以上 redis 配置，Close() 也不会关闭它
+	RedisPool *redis.Pool
+
+	// RulesJSON 规则原文为 json 格式（同 rule_file 为 .json 文件时）
+	RulesJSON bool
+	// Dicts [dicts] 中词表的内容，按词表名给出，每行一个词；未给出的词表从配置的文件名读取
+	Dicts map[string]string
+}
+
+// Engine 嵌入式规则引擎
+// 不依赖配置文件和全局策略，可在同一进程中创建多个；判定逻辑与 http 接口完全一致，但不计入策略统计
+// 缓存查询出错的 rule 按未超出限制处理，同时返回首个错误，由调用方决定是否采用结果
+type Engine struct {
+	policy    *Policy
+	pool      *redis.Pool
+	ownPool   bool
+	logHandle *utility.Logger
+}
+
+// NewEngine 按配置和规则原文（koala_rule.conf 格式）创建引擎
+func NewEngine(options EngineOptions, rules string) (*Engine, error) {
+	policy, err := policyParseStream([]byte(rules), options.RulesJSON, func(dictName, fileName string) ([]byte, error) {
+		if dict, OK := options.Dicts[dictName]; OK {
+			return []byte(dict), nil
+		}
+		return ioutil.ReadFile(fileName)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	engine := &Engine{policy: policy, pool: options.RedisPool, logHandle: utility.NewLogger("")}
+	if engine.pool == nil {
+		engine.pool = newRedisPool(
+			defaultString(options.RedisServer, "127.0.0.1:6379"),
+			options.RedisAuth,
+			defaultInt(options.RedisMaxIdle, 5),
+			defaultDuration(options.RedisIdleTimeout, 300*time.Second),
+			defaultDuration(options.ConnectTimeout, 500*time.Millisecond),
+			defaultDuration(options.ReadTimeout, 500*time.Millisecond),
+			defaultDuration(options.WriteTimeout, 500*time.Millisecond),
+		)
+		engine.ownPool = true
+	}
+	policy.pool = engine.pool
+	for i := range policy.ruleTable {
+		policy.ruleTable[i].pool = engine.pool
+	}
+	return engine, nil
+}
+
+// Browse 查询，同 /rule/browse；params 中 _quota=yes 时附带限额信息
+func (e *Engine) Browse(ctx context.Context, params map[string]string) (RetValue, error) {
+	return e.policy.browse(ctx, params, quotaRequested(params), nil, e.logHandle)
+}
+
+// BrowseAll 完全查询，同 /rule/browse_complete
+func (e *Engine) BrowseAll(ctx context.Context, params map[string]string) ([]RetValue, error) {
+	return e.policy.browseComplete(ctx, params, quotaRequested(params), nil, e.logHandle)
+}
+
+// Update 更新计数，同 /rule/update（同步执行）；任一 rule 更新失败时返回错误
+func (e *Engine) Update(ctx context.Context, params map[string]string) error {
+	results, err := e.policy.update(ctx, params, e.logHandle)
+	if err != nil {
+		return err
+	}
+	for _, one := range results {
+		if !one.OK {
+			return errors.New("rule " + strconv.Itoa(int(one.Return)) + " update failed: " + one.Error)
+		}
+	}
+	return nil
+}
+
+// MultiBrowse 多重查询，同 /multi/browse；结果与 jobs 一一对应
+func (e *Engine) MultiBrowse(ctx context.Context, jobs []map[string]string) ([]RetValue, error) {
+	buffers := make([]JobBuffer, len(jobs))
+	for i, args := range jobs {
+		buffers[i] = JobBuffer{ID: strconv.Itoa(i), args: args, withQuota: quotaRequested(args)}
+	}
+	return e.policy.multiBrowse(ctx, buffers, nil, e.logHandle)
+}
+
+// Close 关闭引擎自己创建的连接池
+func (e *Engine) Close() error {
+	if e.ownPool {
+		return e.pool.Close()
+	}
+	return nil
+}
+
+func defaultString(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+func defaultInt(value, def int) int {
+	if value <= 0 {
+		return def
+	}
+	return value
+}
+
+func defaultDuration(value, def time.Duration) time.Duration {
+	if value <= 0 {
+		return def
+	}
+	return value
+}
@@ -0,0 +1,176 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Embeddable engine tests
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koala
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestNewEngineParseError(t *testing.T) {
+	cases := []struct {
+		name    string
+		options EngineOptions
+		rules   string
+		err     string // 期望的错误信息片段；为空时期望创建成功
+	}{
+		{
+			name:  "section error",
+			rules: "[rules]\nrule : [count] act=ask; [time=10; count=2;] [result=2; return=201]\n" + testPolicyResults,
+			err:   "section error",
+		},
+		{
+			name:  "dict file not found",
+			rules: "[dicts]\nglobal_uid_whitelist : /nonexistent/global_uid_whitelist.dat\n[rules]\n" + testPolicyResults,
+			err:   "cannot load dict file",
+		},
+		{
+			name:    "dict given in options",
+			options: EngineOptions{Dicts: map[string]string{"global_uid_whitelist": "10001\n"}},
+			rules: "[dicts]\nglobal_uid_whitelist : /nonexistent/global_uid_whitelist.dat\n[rules]\n" +
+				"rule : [direct] [uid @ global_uid_whitelist] [time=1; count=0;] [result=1; return=101]\n" + testPolicyResults,
+		},
+		{
+			name:    "bracket rules as json",
+			options: EngineOptions{RulesJSON: true},
+			rules:   testReserveRules,
+			err:     "json",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			engine, err := NewEngine(c.options, c.rules)
+			if c.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				engine.Close()
+				return
+			}
+			if err == nil || engine != nil {
+				t.Fatalf("want error containing %q, got engine %v, error %v", c.err, engine, err)
+			}
+			if !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("want error containing %q, got %q", c.err, err.Error())
+			}
+		})
+	}
+}
+
+func TestEngineBrowseUpdate(t *testing.T) {
+	_, engine := testRedisEngine(t, testDecideRules)
+	ctx := context.Background()
+	params := map[string]string{"act": "ask", "uid": "10001"}
+
+	// count=2：更新两次之前都放行，之后拒绝
+	for n := 0; n < 3; n++ {
+		ret, err := engine.Browse(ctx, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := n < 2; (ret.RetType == 1) != want {
+			t.Fatalf("after %d updates: want allowed %v, got %+v", n, want, ret)
+		}
+		if err := engine.Update(ctx, params); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ret, _ := engine.Browse(ctx, params)
+	if ret.RetCode != 201 || ret.StrReason != "Deny" {
+		t.Errorf("denied result: want rule 201, got %+v", ret)
+	}
+	// 其他 uid 不受影响；没有匹配的 rule 时返回默认结果
+	if ret, err := engine.Browse(ctx, map[string]string{"act": "ask", "uid": "10002"}); err != nil || ret.RetType != 1 {
+		t.Errorf("other uid: want allowed, got %+v, %v", ret, err)
+	}
+	if ret, err := engine.Browse(ctx, map[string]string{"act": "read", "uid": "10001"}); err != nil || ret != engine.policy.retValueTable[0] {
+		t.Errorf("no rule matched: want default result, got %+v, %v", ret, err)
+	}
+
+	rets, err := engine.BrowseAll(ctx, params)
+	if err != nil || len(rets) != 1 || rets[0].RetCode != 201 {
+		t.Errorf("BrowseAll: want rule 201, got %+v, %v", rets, err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := engine.Browse(canceled, params); err != context.Canceled {
+		t.Errorf("Browse with canceled context: want %v, got %v", context.Canceled, err)
+	}
+	if err := engine.Update(canceled, params); err != context.Canceled {
+		t.Errorf("Update with canceled context: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestEngineRedisDown(t *testing.T) {
+	mr, engine := testRedisEngine(t, testDecideRules)
+	ctx := context.Background()
+	params := map[string]string{"act": "ask", "uid": "10001"}
+	for n := 0; n < 2; n++ {
+		if err := engine.Update(ctx, params); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mr.Close()
+
+	// 缓存查询出错：按未超出限制处理，同时返回错误
+	ret, err := engine.Browse(ctx, params)
+	if err == nil || ret.RetType != 1 {
+		t.Errorf("Browse: want allowed result with error, got %+v, %v", ret, err)
+	}
+	if err := engine.Update(ctx, params); err == nil || !strings.Contains(err.Error(), "rule 201 update failed") {
+		t.Errorf("Update: want rule 201 failure, got %v", err)
+	}
+}
+
+func TestEngineRedisPool(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	pool := &redis.Pool{
+		MaxIdle:     1,
+		IdleTimeout: time.Minute,
+		Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", mr.Addr()) },
+	}
+	defer pool.Close()
+
+	engine, err := NewEngine(EngineOptions{RedisPool: pool}, testDecideRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := map[string]string{"act": "ask", "uid": "10001"}
+	if err := engine.Update(context.Background(), params); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := mr.Get(engine.policy.ruleTable[0].getCacheKey(params)); got != "1" {
+		t.Errorf("count through the given pool: want 1, got %q", got)
+	}
+
+	// Close 不关闭调用方给出的连接池
+	if err := engine.Close(); err != nil {
+		t.Fatal(err)
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		t.Errorf("given pool closed by engine: %v", err)
+	}
+}
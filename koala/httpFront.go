@@ -15,6 +15,7 @@ package koala
 import (
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -42,27 +43,102 @@ func FrontListen() {
 		if err != nil {
 			continue
 		}
-		go FrontDispatch(utility.NewHttpConnection(tcpConnection))
+		go frontSniff(tcpConnection)
+	}
+}
+
+/**
+ * 按连接开头的数据判断协议：http 请求交给 FrontDispatch，其余按 gob rpc 处理；关闭 rpc 识别时直接关闭非 http 连接
+ */
+func frontSniff(tcpConnection *utility.TcpConnection) {
+	if err := tcpConnection.SetReadDeadline(time.Now().Add(time.Duration(Config.GetInt("externalReadTimeout")) * time.Millisecond)); err != nil {
+		tcpConnection.Close()
+		return
+	}
+	if err := tcpConnection.ReadProtoBuffer(); err != nil {
+		tcpConnection.Close()
+		return
+	}
+	if tcpConnection.IsHttpProto() {
+		FrontDispatch(utility.NewHttpConnection(tcpConnection))
+		return
+	}
+	if !rpcSniffEnabled() {
+		tcpConnection.Close()
+		return
+	}
+	RpcDispatch(utility.NewRpcConnection(tcpConnection))
+}
+
+/**
+ * listen 端口是否识别 gob rpc：rpc_sniff 配置，yes/no；未配置时，配置了 rpc_listen 则不识别
+ */
+func rpcSniffEnabled() bool {
+	switch Config.Get("rpc_sniff") {
+	case "yes":
+		return true
+	case "no":
+		return false
+	default:
+		return Config.Get("rpc_listen") == ""
 	}
 }
 
 // FrontDispatch .
+// 配置 http_keepalive_timeout 后保持连接：同一连接上的请求（包括 pipeline 发来的多个请求）依次处理、按序应答，
+// 直到客户端要求关闭、空闲超时或达到 http_keepalive_requests；未配置时每个请求后关闭连接
 func FrontDispatch(httpConnection *utility.HttpConnection) {
 	defer httpConnection.Close()
 
-	request, err := httpConnection.ReadRequest(time.Duration(Config.GetInt("externalReadTimeout")) * time.Millisecond)
-	if err != nil {
-		return
+	readTimeout := time.Duration(Config.GetInt("externalReadTimeout")) * time.Millisecond
+	writeTimeout := time.Duration(Config.GetInt("externalWriteTimeout")) * time.Millisecond
+	keepAliveTimeout := time.Duration(Config.GetInt("http_keepalive_timeout")) * time.Millisecond
+	maxRequests := Config.GetInt("http_keepalive_requests")
+	for served := 1; ; served++ {
+		request, err := httpConnection.ReadRequest(readTimeout)
+		if err != nil {
+			return
+		}
+		response := utility.NewHttpResponse()
+
+		// 生成log句柄
+		logHandle := utility.NewLogger("")
+
+		frontCall(request, response, logHandle)
+
+		keepAlive := keepAliveTimeout > 0 && request.IsKeepAlive() && (maxRequests <= 0 || served < maxRequests)
+		if !keepAlive {
+			response.SetHeader("Connection", "close")
+			frontWriteResponse(httpConnection, request, response, writeTimeout)
+			return
+		}
+		response.SetHeader("Connection", "keep-alive")
+		if err := frontWriteResponse(httpConnection, request, response, writeTimeout); err != nil {
+			return
+		}
+		// 之后的请求，等待时长按空闲超时计
+		readTimeout = keepAliveTimeout
 	}
-	response := utility.NewHttpResponse()
+}
 
-	// 生成log句柄
-	logHandle := utility.NewLogger("")
+/**
+ * 写回应答；HEAD 请求不带正文
+ */
+func frontWriteResponse(httpConnection *utility.HttpConnection, request *utility.HttpRequest, response *utility.HttpResponse, writeTimeout time.Duration) error {
+	if request.Method() == "HEAD" {
+		return httpConnection.WriteHeadResponse(response, writeTimeout)
+	}
+	return httpConnection.WriteResponse(response, writeTimeout)
+}
 
+/**
+ * 按请求路径 /a/b 调用 FrontServer 的 DoAB 方法，并记录访问日志；http、rpc 共用
+ */
+func frontCall(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) {
 	pathInfo := strings.Trim(request.PathInfo(), "/")
 	parts := strings.Split(pathInfo, "/")
 	if len(parts) == 2 && frontPattern.Match([]byte(pathInfo)) {
-		methodName := "Do" + strings.Title(parts[0]) + strings.Title(parts[1])
+		methodName := "Do" + camelName(parts[0]) + camelName(parts[1])
 		frontServer := NewFrontServer()
 		frontServerValue := reflect.ValueOf(frontServer)
 		methodValue := frontServerValue.MethodByName(methodName)
@@ -79,13 +155,21 @@ func FrontDispatch(httpConnection *utility.HttpConnection) {
 finished:
 	// 每个请求，记录访问日志
 	requestLogWrite(request, response, logHandle)
+}
 
-	response.SetHeader("Connection", "close")
-	httpConnection.WriteResponse(response, time.Duration(Config.GetInt("externalWriteTimeout"))*time.Millisecond)
+/**
+ * 构造内部请求：rpc、resp 前端把调用转为对 path 接口的 POST 请求，再交给 frontCall
+ */
+func newFrontRequest(path string, remoteAddr string) *utility.HttpRequest {
+	request := utility.NewHttpRequest()
+	request.SetMethod("POST")
+	request.SetUri("/" + strings.Trim(path, "/"))
+	request.SetRemoteAddr(remoteAddr)
+	return request
 }
 
 func requestLogWrite(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) {
-	if request.PathInfo() == "/multi/browse" {
+	if request.PathInfo() == "/multi/browse" || request.PathInfo() == "/multi/update" {
 		// 批量接口，不在此记录notice，在接口内部记录
 		return
 	}
@@ -96,14 +180,39 @@ func requestLogWrite(request *utility.HttpRequest, response *utility.HttpRespons
 
 	gets := request.Gets()
 	for k, v := range gets {
-		logMsg += " " + k + "=" + v
+		logMsg += " " + k + "=" + logParamValue(k, v)
 	}
 	posts := request.Posts()
 	for k, v := range posts {
-		logMsg += " " + k + "=" + v
+		logMsg += " " + k + "=" + logParamValue(k, v)
 	}
 	logMsg += " ]"
 	logMsg += " [ BodyString=" + response.BodyString() + " ]"
 
 	logHandle.Notice(logMsg)
 }
+
+/**
+ * 访问日志中的参数值；admin token 打码，规则原文只记录长度
+ */
+func logParamValue(k, v string) string {
+	switch k {
+	case "_token":
+		return "***"
+	case "rule_stream":
+		return "(" + strconv.Itoa(len(v)) + " bytes)"
+	default:
+		return v
+	}
+}
+
+/**
+ * url 路径段转为方法名片段；下划线分隔的单词首字母大写，如 browse_complete => BrowseComplete
+ */
+func camelName(part string) string {
+	var name string
+	for _, word := range strings.Split(part, "_") {
+		name += strings.Title(word)
+	}
+	return name
+}
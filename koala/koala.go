@@ -25,34 +25,44 @@ var (
 	// 全局 md5 值
 	// 说明：定期检查 rule配置的变化，与此 md5 比较；实现动态更新规则
 	PolicyMd5 string
-
-	// DynamicUpdateFiles .
-	// 需要检查更新的文件列表
-	// 范围：rule 文件 + dicts 文件
-	// 赋值：每次reload规则时，将其中的 dicts 文件记录于此
-	DynamicUpdateFiles []string
 )
 
 func init() {
 	// 设置koala进程并发线程数
 	runtime.GOMAXPROCS(runtime.NumCPU())
-	// 初始化配置
-	Config = NewConfig()
-	// 初始化连接池
-	InitRedisPool()
+	// 空配置：服务进程在 Run() 中按 -f 参数加载；嵌入使用（见 Engine）时不需要配置文件
+	Config = utility.NewConfig()
 }
 
 // Run .
 func Run() {
+	// 加载配置文件
+	Config = NewConfig()
+	// 初始化连接池
+	InitRedisPool()
+
 	// 保存进程的 pid 到文件中，供 stop、restart 脚本引用
 	SavePid(Config.Get("pid_file"))
 
 	// 初始化，并启动 logger 协程
 	go utility.LogRun(Config.GetAll())
 
+	// 启动判定事件发送协程（未配置 event_sink 时不启用）
+	startEventAgent()
+
+	// 初始化策略版本历史
+	PolicyVersions = NewPolicyHistory(Config.GetInt("policy_history_size"))
+
 	// 首次加载规则
+	if policySourceIsRedis() {
+		if loaded, err := RedisPolicyInterpreter(); loaded == nil {
+			panic(err.Error())
+		}
+		return
+	}
 	if err := PolicyInterpreter(""); err != nil {
 		panic(err.Error())
 	}
 	PolicyMd5 = NewPolicyMD5()
+	PolicyVersions.Record(CurrentPolicy(), PolicyMd5, policyOriginFile)
 }
@@ -20,11 +20,15 @@ import (
 	"time"
 
 	"github.com/gomodule/redigo/redis"
+
+	"github.com/heiyeluren/koala/rulefmt"
 )
 
 const (
 	// BaseKeySuffix base附加cache key的后缀；在getCacheKey()的key后追加
 	BaseKeySuffix = "_B"
+	// ReqIDKeySuffix 幂等更新标记 key 的后缀；在getCacheKey()的key后追加，再追加 _reqid
+	ReqIDKeySuffix = "_R|"
 )
 
 // Rule rule类型
@@ -38,168 +42,160 @@ type Rule struct {
 	erase2     int32
 	result     int32
 	returnCode int32
+	pool       *redis.Pool // 嵌入式 Engine 的连接池；为空时使用全局 RedisPool
 }
 
 /************************************************************
                 KoalaRule 构建，build，相关方法
 ************************************************************/
 
-// Constructor .KoalaRule 的构造器
-func (k *Rule) Constructor(r string) error {
+/**
+ * 取一个 redis 连接；用完需 Close
+ */
+func (k *Rule) redisConn() redis.Conn {
+	if k.pool != nil {
+		return k.pool.Get()
+	}
+	return RedisPool.Get()
+}
+
+// Constructor .KoalaRule 的构造器；r 为 rule 配置行冒号之后的部分，dicts 为 @ 语句可引用的词表
+// 各段的切分与 koala_ruleconv 一致（rulefmt.ParseRule），段与段之间的空白不影响解析
+func (k *Rule) Constructor(r string, dicts map[string]map[string]string) error {
 	// [direct] [qid @ global_qid_whitelist] [time=1; count=0;] [result=1; return=101]
 	// [count] [act=ask;qid=+;] [time=2; count=1;] [result=2; return=201]
 	// [base] [act=ask;ip=+;] [base=50; time=10; count=1;] [result=2; return=203]
-	sections := strings.Split(r, "] [")
-	if len(sections) != 4 {
-		return errors.New("rule syntax error: section error")
-	}
-	for i := range sections {
-		sections[i] = strings.Trim(sections[i], emptyRunes+"[]")
+	rule, err := rulefmt.ParseRule(r)
+	if err != nil {
+		return err
 	}
-	k.method = sections[0]
+	return k.build(&rule, dicts)
+}
+
+/**
+ * 由结构化的规则配置构造 rule；方括号格式、json 格式的规则文件共用
+ */
+func (k *Rule) build(r *rulefmt.Rule, dicts map[string]map[string]string) error {
+	k.method = r.Method
 	if k.method != "count" && k.method != "base" && k.method != "direct" && k.method != "leak" {
 		return errors.New("rule syntax error: method error")
 	}
-	k.keys = make(map[string]KoalaKey, 10)
-	if err := k.getKeys(sections[1]); err != nil {
-		return err
-	}
-	// 解析剩余的 count、returnCode 等 参数
-	if err := k.getCountAndRet(sections[2], sections[3]); err != nil {
-		return err
+	k.keys = make(map[string]KoalaKey, len(r.Keys))
+	for _, key := range r.Keys {
+		if err := k.addKey(key, dicts); err != nil {
+			return err
+		}
 	}
+	k.base = thresholdValue(r.Base)
+	k.time = thresholdValue(r.Time)
+	k.count = thresholdValue(r.Count)
+	k.erase1 = thresholdValue(r.Erase1)
+	k.erase2 = thresholdValue(r.Erase2)
+	k.result = r.Result
+	k.returnCode = r.Return
 	return nil
 }
 
 /**
- * 解析 KoalaRule 的 count、returnCode 等 参数
+ * 阀值配置；未配置时为 0
  */
-func (k *Rule) getCountAndRet(val, ret string) error {
-	val = strings.Trim(val, emptyRunes+";")
-	ret = strings.Trim(ret, emptyRunes+";")
-	vals := strings.Split(val, ";")
-	for _, s := range vals {
-		s = strings.Trim(s, emptyRunes)
-		parts := strings.SplitN(s, "=", 2)
-		if len(parts) != 2 {
-			return errors.New("rule syntax error: value error")
-		}
-		valueName := strings.Trim(parts[0], emptyRunes)
-		valueData, err := strconv.Atoi(strings.Trim(parts[1], emptyRunes))
-		if err != nil {
-			return errors.New("rule syntax error: value error")
-		}
-		switch valueName {
-		case "base":
-			k.base = int32(valueData)
-		case "time":
-			k.time = int32(valueData)
-		case "count":
-			k.count = int32(valueData)
-		case "erase1":
-			k.erase1 = int32(valueData)
-		case "erase2":
-			k.erase2 = int32(valueData)
-		default:
-			return errors.New("rule syntax error: value error")
-		}
-	}
-	rets := strings.Split(ret, ";")
-	for _, s := range rets {
-		s = strings.Trim(s, emptyRunes)
-		parts := strings.SplitN(s, "=", 2)
-		if len(parts) != 2 {
-			return errors.New("rule syntax error: value error")
-		}
-		valueName := strings.Trim(parts[0], emptyRunes)
-		valueData, err := strconv.Atoi(strings.Trim(parts[1], emptyRunes))
-		if err != nil {
-			return errors.New("rule syntax error: value error")
-		}
-		switch valueName {
-		case "result":
-			k.result = int32(valueData)
-		case "return":
-			k.returnCode = int32(valueData)
-		default:
-			return errors.New("rule syntax error: value error")
-		}
+func thresholdValue(value *int32) int32 {
+	if value == nil {
+		return 0
 	}
-	return nil
+	return *value
 }
 
 /**
- * 解析 KoalaRule 的 keys 参数
+ * 解析单个 key 表达式并加入 rule；如 act=ask、ip=+、qid @ global_qid_whitelist
  */
-func (k *Rule) getKeys(ki string) error {
-	// act=ask;ip=+;
-	ki = strings.Trim(ki, emptyRunes+";")
-	allKey := strings.Split(ki, ";")
-	for i := range allKey {
-		allKey[i] = strings.Trim(allKey[i], emptyRunes)
+func (k *Rule) addKey(key string, dicts map[string]map[string]string) error {
+	key = strings.Trim(key, emptyRunes)
 
-		// 抽取 词表 @语句 集合key
-		// qid @ global_qid_whitelist
-		parts := strings.SplitN(allKey[i], "@", 2)
-		if len(parts) == 2 {
-			keyValue := new(GroupKey)
-			if err := keyValue.build("@", parts[0], parts[1]); err != nil {
-				return err
-			}
-			keyName := strings.Trim(parts[0], emptyRunes+"!")
-			k.keys[keyName] = keyValue
-			continue
+	// 抽取 词表 @语句 集合key
+	// qid @ global_qid_whitelist
+	parts := strings.SplitN(key, "@", 2)
+	if len(parts) == 2 {
+		keyValue := new(GroupKey)
+		if err := keyValue.build("@", parts[0], parts[1]); err != nil {
+			return err
 		}
+		if err := keyValue.bindDict(dicts); err != nil {
+			return err
+		}
+		k.keys[strings.Trim(parts[0], emptyRunes+"!")] = keyValue
+		return nil
+	}
 
-		// 抽取 小于 < 语句 范围 key
-		parts = strings.SplitN(allKey[i], "<", 2)
-		if len(parts) == 2 {
-			keyValue := new(RangeKey)
-			if err := keyValue.build("<", parts[0], parts[1]); err != nil {
-				return err
-			}
-			keyName := strings.Trim(parts[0], emptyRunes+"!")
-			k.keys[keyName] = keyValue
-			continue
+	// 抽取 小于 < 语句 范围 key
+	parts = strings.SplitN(key, "<", 2)
+	if len(parts) == 2 {
+		keyValue := new(RangeKey)
+		if err := keyValue.build("<", parts[0], parts[1]); err != nil {
+			return err
 		}
+		k.keys[strings.Trim(parts[0], emptyRunes+"!")] = keyValue
+		return nil
+	}
 
-		// 抽取 小于 > 语句 范围key
-		parts = strings.SplitN(allKey[i], ">", 2)
-		if len(parts) == 2 {
-			keyValue := new(RangeKey)
-			if err := keyValue.build(">", parts[0], parts[1]); err != nil {
-				return err
-			}
-			keyName := strings.Trim(parts[0], emptyRunes+"!")
-			k.keys[keyName] = keyValue
-			continue
+	// 抽取 小于 > 语句 范围key
+	parts = strings.SplitN(key, ">", 2)
+	if len(parts) == 2 {
+		keyValue := new(RangeKey)
+		if err := keyValue.build(">", parts[0], parts[1]); err != nil {
+			return err
 		}
+		k.keys[strings.Trim(parts[0], emptyRunes+"!")] = keyValue
+		return nil
+	}
 
-		// 处理其他的 以 = 分割的语句，否则报错
-		parts = strings.SplitN(allKey[i], "=", 2)
-		if len(parts) != 2 {
-			return errors.New("rule syntax error: keys error,miss sp =")
+	// 处理其他的 以 = 分割的语句，否则报错
+	parts = strings.SplitN(key, "=", 2)
+	if len(parts) != 2 {
+		return errors.New("rule syntax error: keys error,miss sp =")
+	}
+	keyName := strings.Trim(parts[0], emptyRunes+"!")
+	if strings.ContainsAny(parts[1], "+-*") {
+		keyValue := new(RangeKey) // 范围
+		if err := keyValue.build("=", parts[0], parts[1]); err != nil {
+			return err
 		}
-		if strings.ContainsAny(parts[1], "+-*") {
-			keyValue := new(RangeKey) // 范围
-			if err := keyValue.build("=", parts[0], parts[1]); err != nil {
-				return err
-			}
-			keyName := strings.Trim(parts[0], emptyRunes+"!")
-			k.keys[keyName] = keyValue
-		} else {
-			keyValue := new(GroupKey) // 集合
-			if err := keyValue.build("=", parts[0], parts[1]); err != nil {
-				return err
-			}
-			keyName := strings.Trim(parts[0], emptyRunes+"!")
-			k.keys[keyName] = keyValue
+		k.keys[keyName] = keyValue
+	} else {
+		keyValue := new(GroupKey) // 集合
+		if err := keyValue.build("=", parts[0], parts[1]); err != nil {
+			return err
 		}
-
+		k.keys[keyName] = keyValue
 	}
 	return nil
 }
 
+/**
+ * dump()
+ * 输出 rule 的规范化描述；keys 按字典序排列，用于规则比对（diff）、调试
+ */
+func (k *Rule) dump() string {
+	keyNames := make([]string, 0, len(k.keys))
+	for keyName := range k.keys {
+		keyNames = append(keyNames, keyName)
+	}
+	sort.Strings(keyNames)
+
+	ret := "[" + k.method + "] ["
+	for _, keyName := range keyNames {
+		ret += keyName + ":" + k.keys[keyName].dump() + ";"
+	}
+	ret += "] [base=" + strconv.Itoa(int(k.base))
+	ret += "; time=" + strconv.Itoa(int(k.time))
+	ret += "; count=" + strconv.Itoa(int(k.count))
+	ret += "; erase1=" + strconv.Itoa(int(k.erase1))
+	ret += "; erase2=" + strconv.Itoa(int(k.erase2))
+	ret += ";] [result=" + strconv.Itoa(int(k.result))
+	ret += "; return=" + strconv.Itoa(int(k.returnCode)) + ";]"
+	return ret
+}
+
 /************************************************************
                 KoalaRule 使用过程，matche，相关方法
 ************************************************************/
@@ -242,7 +238,7 @@ func (k *Rule) getCacheKey(gets map[string]string) string {
  * 查询：查询规则当前的缓存值
  */
 func (k *Rule) getCacheValue(cacheKey string) (int, error) {
-	redisConn := RedisPool.Get()
+	redisConn := k.redisConn()
 	defer redisConn.Close()
 
 	var err error
@@ -259,11 +255,189 @@ func (k *Rule) getCacheValue(cacheKey string) (int, error) {
 	return cacheValue, nil
 }
 
+// RuleState 规则在缓存中的当前状态
+type RuleState struct {
+	Count     int64 `json:"count"`                // count、base 规则的计数值
+	TTL       int64 `json:"ttl"`                  // 计数 key（leak 为列表）的剩余有效期，秒；-2 不存在，-1 永久
+	BaseCount int64 `json:"base_count,omitempty"` // base 规则 _B 后缀 key 的计数值
+	BaseTTL   int64 `json:"base_ttl,omitempty"`   // base 规则 _B 后缀 key 的剩余有效期
+	LeakLen   int64 `json:"leak_len,omitempty"`   // leak 规则列表长度
+	LeakEdge  int64 `json:"leak_edge,omitempty"`  // leak 规则第 count 个元素的时间戳
+	// leak 规则最新的 count+1 个元素中，仍在 time 秒窗口内的个数，及其中最早一个的时间戳
+	LeakUsed   int64 `json:"leak_used,omitempty"`
+	LeakOldest int64 `json:"leak_oldest,omitempty"`
+}
+
+/**
+ * 查询：读取规则的缓存状态（只读，不做任何清理、更新）
+ */
+func (k *Rule) inspect(cacheKey string) (*RuleState, error) {
+	states, err := k.multiInspect([]string{cacheKey})
+	if err != nil {
+		return nil, err
+	}
+	return states[cacheKey], nil
+}
+
+/**
+ * 多重查询：读取多个 key 的缓存状态，一次发送；返回按 key 索引的状态
+ */
+func (k *Rule) multiInspect(cacheKeys []string) (map[string]*RuleState, error) {
+	states := make(map[string]*RuleState, len(cacheKeys))
+	if k.method == "direct" {
+		for _, key := range cacheKeys {
+			states[key] = new(RuleState)
+		}
+		return states, nil
+	}
+
+	redisConn := k.redisConn()
+	defer redisConn.Close()
+
+	for _, key := range cacheKeys {
+		k.sendInspect(redisConn, key)
+	}
+	if err := redisConn.Flush(); err != nil {
+		return nil, err
+	}
+	for _, key := range cacheKeys {
+		state, err := k.receiveInspect(redisConn)
+		if err != nil {
+			return nil, err
+		}
+		states[key] = state
+	}
+	return states, nil
+}
+
+/**
+ * 按规则类型，发送读取缓存状态需要的命令；回复由 receiveInspect 按相同顺序读取
+ */
+func (k *Rule) sendInspect(redisConn redis.Conn, cacheKey string) {
+	switch k.method {
+	case "count":
+		redisConn.Send("GET", cacheKey)
+		redisConn.Send("TTL", cacheKey)
+	case "base":
+		redisConn.Send("GET", cacheKey)
+		redisConn.Send("TTL", cacheKey)
+		redisConn.Send("GET", cacheKey+BaseKeySuffix)
+		redisConn.Send("TTL", cacheKey+BaseKeySuffix)
+	case "leak":
+		redisConn.Send("LLEN", cacheKey)
+		redisConn.Send("TTL", cacheKey)
+		redisConn.Send("LINDEX", cacheKey, k.count)
+		redisConn.Send("LRANGE", cacheKey, 0, k.count)
+	}
+}
+
+/**
+ * 读取 sendInspect 发送的命令的回复，得出一个 key 的缓存状态
+ */
+func (k *Rule) receiveInspect(redisConn redis.Conn) (*RuleState, error) {
+	state := new(RuleState)
+	var targets []*int64
+	switch k.method {
+	case "count":
+		targets = []*int64{&state.Count, &state.TTL}
+	case "base":
+		targets = []*int64{&state.Count, &state.TTL, &state.BaseCount, &state.BaseTTL}
+	case "leak":
+		targets = []*int64{&state.LeakLen, &state.TTL, &state.LeakEdge}
+	}
+	for _, target := range targets {
+		value, err := redis.Int64(redisConn.Receive())
+		if err != nil && err != redis.ErrNil {
+			return nil, err
+		}
+		*target = value
+	}
+	if k.method == "leak" {
+		recent, err := redis.Int64s(redisConn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		// 列表按时间从新到旧排列，窗口内的元素在前；判定条件与 leakBrowse 一致
+		now := time.Now().Unix()
+		for _, element := range recent {
+			if now-element > int64(k.time) {
+				break
+			}
+			state.LeakUsed++
+			state.LeakOldest = element
+		}
+	}
+	return state, nil
+}
+
+/**
+ * 匹配：每个 key 的参数都已传入（非空）且匹配时，rule 命中
+ */
+func (k *Rule) satisfied(params map[string]string) bool {
+	for name, key := range k.keys {
+		value := params[name]
+		if value == "" || !key.matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * 是否需要更新计数：direct 规则、count 为 0 的 count 规则没有计数
+ */
+func (k *Rule) updatable() bool {
+	switch k.method {
+	case "count":
+		return k.count != 0
+	case "base", "leak":
+		return true
+	default:
+	}
+	return false
+}
+
+/**
+ * 查询：按规则类型查缓存值，与阀值比较，判断是否超出限制；direct 规则命中即超出
+ */
+func (k *Rule) browse(cacheKey string) (bool, error) {
+	switch k.method {
+	case "direct":
+		return true, nil
+	case "count":
+		return k.countBrowse(cacheKey)
+	case "base":
+		return k.baseBrowse(cacheKey)
+	case "leak":
+		return k.leakBrowse(cacheKey)
+	default:
+	}
+	return false, nil
+}
+
+/**
+ * 判定：按缓存状态判断是否超出限制，判定逻辑与各 Browse 方法一致
+ */
+func (k *Rule) isOut(state *RuleState) bool {
+	switch k.method {
+	case "direct":
+		return true
+	case "count":
+		return k.count != 0 && state.Count >= int64(k.count)
+	case "base":
+		return k.base != 0 && state.Count >= int64(k.base) && k.count != 0 && state.BaseCount >= int64(k.count)
+	case "leak":
+		return state.LeakLen > int64(k.count) && time.Now().Unix()-state.LeakEdge <= int64(k.time)
+	default:
+	}
+	return false
+}
+
 /**
  * 浏览；count规则缓存查询、比较
  */
 func (k *Rule) countBrowse(cacheKey string) (bool, error) {
-	redisConn := RedisPool.Get()
+	redisConn := k.redisConn()
 	defer redisConn.Close()
 
 	var err error
@@ -287,7 +461,7 @@ func (k *Rule) countBrowse(cacheKey string) (bool, error) {
  * 更新；count规则缓存更新
  */
 func (k *Rule) countUpdate(cacheKey string) error {
-	redisConn := RedisPool.Get()
+	redisConn := k.redisConn()
 	defer redisConn.Close()
 
 	var exists int
@@ -297,17 +471,7 @@ func (k *Rule) countUpdate(cacheKey string) error {
 	}
 	// set new cache
 	if exists == 0 {
-		var expireTime int32
-		// 86400 按照 自然天计算 过期时间
-		if k.time == 86400 {
-			y, m, d := time.Now().Date()
-			loc, _ := time.LoadLocation("Asia/Shanghai")
-			dayEnd := time.Date(y, m, d, 23, 59, 59, 0, loc).Unix()
-			expireTime = int32(dayEnd - time.Now().Unix())
-		} else {
-			expireTime = k.time
-		}
-
+		expireTime := k.countExpireTime()
 		if _, err := redis.String(redisConn.Do("SETEX", cacheKey, expireTime, 1)); err != nil {
 			return err
 		}
@@ -323,11 +487,24 @@ func (k *Rule) countUpdate(cacheKey string) error {
 	return nil
 }
 
+/**
+ * count规则新建计数 key 的过期时间；86400 按照 自然天计算 过期时间
+ */
+func (k *Rule) countExpireTime() int32 {
+	if k.time != 86400 {
+		return k.time
+	}
+	y, m, d := time.Now().Date()
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	dayEnd := time.Date(y, m, d, 23, 59, 59, 0, loc).Unix()
+	return int32(dayEnd - time.Now().Unix())
+}
+
 /**
  * 浏览；base方法缓存查询、比较
  */
 func (k *Rule) baseBrowse(cacheKey string) (bool, error) {
-	redisConn := RedisPool.Get()
+	redisConn := k.redisConn()
 	defer redisConn.Close()
 
 	var err error
@@ -366,7 +543,7 @@ func (k *Rule) baseBrowse(cacheKey string) (bool, error) {
  * 更新；base方法缓存更新
  */
 func (k *Rule) baseUpdate(cacheKey string) error {
-	redisConn := RedisPool.Get()
+	redisConn := k.redisConn()
 	defer redisConn.Close()
 
 	exists, err := redis.Int(redisConn.Do("EXISTS", cacheKey))
@@ -374,9 +551,7 @@ func (k *Rule) baseUpdate(cacheKey string) error {
 		return err
 	}
 	if exists == 0 {
-		y, m, d := time.Now().Date()
-		dayEnd := time.Date(y, m, d, 23, 59, 59, 0, time.UTC).Unix()
-		expireTime := int32(dayEnd - time.Now().Unix())
+		expireTime := baseExpireTime()
 		if _, err = redis.String(redisConn.Do("SETEX", cacheKey, expireTime, 1)); err != nil {
 			return err
 		}
@@ -409,12 +584,21 @@ func (k *Rule) baseUpdate(cacheKey string) error {
 	return nil
 }
 
+/**
+ * base方法新建计数 key 的过期时间，为当天结束（UTC）
+ */
+func baseExpireTime() int32 {
+	y, m, d := time.Now().Date()
+	dayEnd := time.Date(y, m, d, 23, 59, 59, 0, time.UTC).Unix()
+	return int32(dayEnd - time.Now().Unix())
+}
+
 /**
  * leak模式--查询
  *
  */
 func (k *Rule) leakBrowse(cacheKey string) (bool, error) {
-	redisConn := RedisPool.Get()
+	redisConn := k.redisConn()
 	defer redisConn.Close()
 
 	listLen, err := redis.Int(redisConn.Do("LLEN", cacheKey))
@@ -445,7 +629,7 @@ func (k *Rule) leakBrowse(cacheKey string) (bool, error) {
  * 清理队尾过期多余元素
  */
 func (k *Rule) leakClear(cacheKey string, listLen int) {
-	redisConn := RedisPool.Get()
+	redisConn := k.redisConn()
 	defer redisConn.Close()
 
 	for listLen > int(k.count+1) {
@@ -460,7 +644,7 @@ func (k *Rule) leakClear(cacheKey string, listLen int) {
  * leak模式--更新
  */
 func (k *Rule) leakUpdate(cacheKey string) error {
-	redisConn := RedisPool.Get()
+	redisConn := k.redisConn()
 	defer redisConn.Close()
 
 	now := time.Now().Unix()
@@ -473,35 +657,103 @@ func (k *Rule) leakUpdate(cacheKey string) error {
 	return nil
 }
 
+/**
+ * 重置；删除规则在缓存中的全部 key（count、leak 计数 key，base 另有 _B 后缀 key），返回删除的 key 及实际删除数量
+ */
+func (k *Rule) reset(cacheKey string) ([]string, int, error) {
+	var keys []string
+	switch k.method {
+	case "count", "leak":
+		keys = []string{cacheKey}
+	case "base":
+		keys = []string{cacheKey, cacheKey + BaseKeySuffix}
+	default:
+		return nil, 0, nil
+	}
+
+	redisConn := k.redisConn()
+	defer redisConn.Close()
+
+	args := make([]interface{}, len(keys))
+	for i := range keys {
+		args[i] = keys[i]
+	}
+	deleted, err := redis.Int(redisConn.Do("DEL", args...))
+	if err != nil {
+		return nil, 0, err
+	}
+	return keys, deleted, nil
+}
+
+// leak 反馈脚本：从队首（最新）移除至多 ARGV[1] 个元素，返回 {移除前长度, 移除后长度}
+var leakFeedbackScript = redis.NewScript(1, `
+local n = redis.call('LLEN', KEYS[1])
+local erase = tonumber(ARGV[1])
+if erase > n then erase = n end
+if erase > 0 then redis.call('LTRIM', KEYS[1], erase, -1) end
+return {n, n - erase}
+`)
+
+// count 反馈脚本：计数值减少至多 ARGV[1]，不小于 0，保留原有效期；返回 {减少前, 减少后}
+var countFeedbackScript = redis.NewScript(1, `
+local v = redis.call('GET', KEYS[1])
+if not v then return {0, 0} end
+v = tonumber(v)
+local erase = tonumber(ARGV[1])
+if erase > v then erase = v end
+if erase > 0 then redis.call('DECRBY', KEYS[1], erase) end
+return {v, v - erase}
+`)
+
 /**
  * leak模式--反馈
- * 根据指令，减少桶内若干元素
+ * 根据指令，减少桶内若干元素；元素不足时清空为止
+ */
+func (k *Rule) leakFeedback(cacheKey string, feedback int) (int64, int64, error) {
+	return k.runFeedbackScript(leakFeedbackScript, cacheKey, feedback)
+}
+
+/**
+ * count模式--反馈
+ * 根据指令，减少计数值；最多减到 0
  */
-func (k *Rule) leakFeedback(cacheKey string, feedback int) error {
-	redisConn := RedisPool.Get()
+func (k *Rule) countFeedback(cacheKey string, feedback int) (int64, int64, error) {
+	return k.runFeedbackScript(countFeedbackScript, cacheKey, feedback)
+}
+
+/**
+ * 执行反馈脚本，返回反馈前后的值
+ */
+func (k *Rule) runFeedbackScript(script *redis.Script, cacheKey string, feedback int) (int64, int64, error) {
+	redisConn := k.redisConn()
 	defer redisConn.Close()
 
-	for feedback > 0 {
-		if _, err := redis.Int64(redisConn.Do("LPOP", cacheKey)); err != nil {
-			return err
-		}
-		feedback--
+	values, err := redis.Int64s(script.Do(redisConn, cacheKey, feedback))
+	if err != nil {
+		return 0, 0, err
 	}
-	return nil
+	if len(values) != 2 {
+		return 0, 0, errors.New("feedback script reply error")
+	}
+	return values[0], values[1], nil
 }
 
 /**
  * 多重浏览；direct规则直接判定
  */
 func (k *Rule) multiDirectBrowse(cacheKeys []interface{}) (map[string]bool, error) {
-	return nil, nil
+	multiResult := make(map[string]bool, len(cacheKeys))
+	for _, key := range cacheKeys {
+		multiResult[key.(string)] = true
+	}
+	return multiResult, nil
 }
 
 /**
  * 多重浏览；count规则缓存查询、比较
  */
 func (k *Rule) multiCountBrowse(cacheKeys []interface{}) (map[string]bool, error) {
-	redisConn := RedisPool.Get()
+	redisConn := k.redisConn()
 	defer redisConn.Close()
 
 	multiResult := make(map[string]bool, len(cacheKeys))
@@ -533,5 +785,285 @@ func (k *Rule) multiCountBrowse(cacheKeys []interface{}) (map[string]bool, error
  * 多重浏览；base方法缓存查询、比较
  */
 func (k *Rule) multiBaseBrowse(cacheKeys []interface{}) (map[string]bool, error) {
-	return nil, nil
+	redisConn := k.redisConn()
+	defer redisConn.Close()
+
+	// 每个 key 读取计数值、_B 后缀计数值，一次发送
+	for _, key := range cacheKeys {
+		redisConn.Send("GET", key)
+		redisConn.Send("GET", key.(string)+BaseKeySuffix)
+	}
+	if err := redisConn.Flush(); err != nil {
+		return nil, err
+	}
+
+	multiResult := make(map[string]bool, len(cacheKeys))
+	for _, key := range cacheKeys {
+		cacheValue, err := receiveInt(redisConn)
+		if err != nil {
+			return nil, err
+		}
+		timeValue, err := receiveInt(redisConn)
+		if err != nil {
+			return nil, err
+		}
+		isOut := k.base != 0 && k.base <= int32(cacheValue) && k.count != 0 && k.count <= int32(timeValue)
+		multiResult[key.(string)] = isOut
+	}
+	return multiResult, nil
+}
+
+/**
+ * 多重浏览；leak方法缓存查询、比较
+ * 与 leakBrowse 一致，桶内元素多于 count 时，异步清理队尾多余元素
+ */
+func (k *Rule) multiLeakBrowse(cacheKeys []interface{}) (map[string]bool, error) {
+	redisConn := k.redisConn()
+	defer redisConn.Close()
+
+	// 每个 key 读取列表长度、第 count 个元素，一次发送
+	for _, key := range cacheKeys {
+		redisConn.Send("LLEN", key)
+		redisConn.Send("LINDEX", key, k.count)
+	}
+	if err := redisConn.Flush(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	multiResult := make(map[string]bool, len(cacheKeys))
+	for _, key := range cacheKeys {
+		listLen, err := receiveInt(redisConn)
+		if err != nil {
+			return nil, err
+		}
+		edgeElement, err := receiveInt(redisConn)
+		if err != nil {
+			return nil, err
+		}
+		if listLen == 0 || listLen <= int(k.count) {
+			multiResult[key.(string)] = false
+			continue
+		}
+		go k.leakClear(key.(string), listLen)
+		multiResult[key.(string)] = int32(now-int64(edgeElement)) <= k.time
+	}
+	return multiResult, nil
+}
+
+/**
+ * 读取一个 pipeline 回复并转为整数；key 不存在时为 0
+ */
+func receiveInt(redisConn redis.Conn) (int, error) {
+	value, err := redis.Int(redisConn.Receive())
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return value, err
+}
+
+/**
+ * 多重更新；count规则缓存更新
+ * key 不存在时以 0 新建并设置过期时间，随后自增，与 countUpdate 结果一致；返回与 cacheKeys 对应的错误
+ */
+func (k *Rule) multiCountUpdate(cacheKeys []string) []error {
+	redisConn := k.redisConn()
+	defer redisConn.Close()
+
+	expireTime := k.countExpireTime()
+	for _, key := range cacheKeys {
+		redisConn.Send("SET", key, 0, "EX", expireTime, "NX")
+		redisConn.Send("INCR", key)
+	}
+	errs := make([]error, len(cacheKeys))
+	if err := redisConn.Flush(); err != nil {
+		return fillErrors(errs, err)
+	}
+	for i := range cacheKeys {
+		if _, err := redisConn.Receive(); err != nil && err != redis.ErrNil {
+			errs[i] = err
+		}
+		if _, err := redis.Int(redisConn.Receive()); err != nil {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+/**
+ * 多重更新；base方法缓存更新
+ * 与 baseUpdate 一致：新建的计数 key 值为 1，不更新 _B 后缀 key；已有计数达到 base 后，才更新 _B 后缀 key
+ */
+func (k *Rule) multiBaseUpdate(cacheKeys []string) []error {
+	redisConn := k.redisConn()
+	defer redisConn.Close()
+
+	expireTime := baseExpireTime()
+	for _, key := range cacheKeys {
+		redisConn.Send("SET", key, 0, "EX", expireTime, "NX")
+		redisConn.Send("INCR", key)
+	}
+	errs := make([]error, len(cacheKeys))
+	if err := redisConn.Flush(); err != nil {
+		return fillErrors(errs, err)
+	}
+	var timeKeys []int
+	for i := range cacheKeys {
+		if _, err := redisConn.Receive(); err != nil && err != redis.ErrNil {
+			errs[i] = err
+		}
+		cacheValue, err := redis.Int(redisConn.Receive())
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if cacheValue > 1 && k.base != 0 && k.base <= int32(cacheValue) {
+			timeKeys = append(timeKeys, i)
+		}
+	}
+	if len(timeKeys) == 0 {
+		return errs
+	}
+
+	for _, i := range timeKeys {
+		redisConn.Send("SET", cacheKeys[i]+BaseKeySuffix, 0, "EX", k.time, "NX")
+		redisConn.Send("INCR", cacheKeys[i]+BaseKeySuffix)
+	}
+	if err := redisConn.Flush(); err != nil {
+		for _, i := range timeKeys {
+			errs[i] = err
+		}
+		return errs
+	}
+	for _, i := range timeKeys {
+		if _, err := redisConn.Receive(); err != nil && err != redis.ErrNil {
+			errs[i] = err
+		}
+		if _, err := redis.Int(redisConn.Receive()); err != nil {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+/**
+ * 多重更新；leak方法缓存更新
+ */
+func (k *Rule) multiLeakUpdate(cacheKeys []string) []error {
+	redisConn := k.redisConn()
+	defer redisConn.Close()
+
+	now := time.Now().Unix()
+	for _, key := range cacheKeys {
+		redisConn.Send("LPUSH", key, now)
+		redisConn.Send("EXPIRE", key, k.time)
+	}
+	errs := make([]error, len(cacheKeys))
+	if err := redisConn.Flush(); err != nil {
+		return fillErrors(errs, err)
+	}
+	for i := range cacheKeys {
+		if _, err := redis.Int(redisConn.Receive()); err != nil {
+			errs[i] = err
+		}
+		if _, err := redis.Int(redisConn.Receive()); err != nil {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+/**
+ * 连接级错误，所有 key 均记为失败
+ */
+func fillErrors(errs []error, err error) []error {
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+/************************************************************
+                幂等更新（_reqid）相关方法
+************************************************************/
+
+/**
+ * 幂等更新：标记不存在时更新计数并写入标记，已存在时跳过；在同一脚本中完成，计数与标记总是一致
+ * KEYS：标记 key、计数 key、_B 后缀 key；ARGV：标记有效期、rule 类型，其后为各类型的参数
+ *   count：计数 key 的过期时间；base：计数 key 的过期时间、base、_B 后缀 key 的过期时间；leak：写入的时间戳、过期时间
+ * 更新与 countUpdate、baseUpdate、leakUpdate 一致；返回 1 表示已更新，0 表示已经更新过
+ */
+var reqIDUpdateScript = redis.NewScript(3, `
+if redis.call('EXISTS', KEYS[1]) == 1 then return 0 end
+local method = ARGV[2]
+if method == 'count' then
+  if redis.call('EXISTS', KEYS[2]) == 0 then redis.call('SET', KEYS[2], 1, 'EX', ARGV[3]) else redis.call('INCR', KEYS[2]) end
+elseif method == 'base' then
+  if redis.call('EXISTS', KEYS[2]) == 0 then
+    redis.call('SET', KEYS[2], 1, 'EX', ARGV[3])
+  else
+    local n = redis.call('INCR', KEYS[2])
+    local base = tonumber(ARGV[4])
+    if base > 0 and n >= base then
+      if redis.call('EXISTS', KEYS[3]) == 0 then redis.call('SET', KEYS[3], 1, 'EX', ARGV[5]) else redis.call('INCR', KEYS[3]) end
+    end
+  end
+elseif method == 'leak' then
+  redis.call('LPUSH', KEYS[2], ARGV[3])
+  redis.call('EXPIRE', KEYS[2], ARGV[4])
+end
+redis.call('SET', KEYS[1], 1, 'EX', ARGV[1])
+return 1
+`)
+
+/**
+ * 幂等更新脚本的参数
+ */
+func (k *Rule) reqIDUpdateArgs(cacheKey string, reqID string, ttl int) []interface{} {
+	args := []interface{}{cacheKey + ReqIDKeySuffix + reqID, cacheKey, cacheKey + BaseKeySuffix, ttl, k.method}
+	switch k.method {
+	case "count":
+		args = append(args, k.countExpireTime())
+	case "base":
+		args = append(args, baseExpireTime(), k.base, k.time)
+	case "leak":
+		args = append(args, time.Now().Unix(), k.time)
+	default:
+	}
+	return args
+}
+
+/**
+ * 幂等更新：ttl 秒内同一 reqID 只更新一次计数；返回 false 表示已经更新过，本次跳过
+ */
+func (k *Rule) updateOnce(cacheKey string, reqID string, ttl int) (bool, error) {
+	redisConn := k.redisConn()
+	defer redisConn.Close()
+
+	return redis.Bool(reqIDUpdateScript.Do(redisConn, k.reqIDUpdateArgs(cacheKey, reqID, ttl)...))
+}
+
+/**
+ * 批量幂等更新：reqIDs 与 cacheKeys 一一对应，一次发送；返回每个 key 是否更新，以及出错的 key 的错误
+ */
+func (k *Rule) multiUpdateOnce(cacheKeys []string, reqIDs []string, ttl int) ([]bool, []error) {
+	updated := make([]bool, len(cacheKeys))
+	errs := make([]error, len(cacheKeys))
+	redisConn := k.redisConn()
+	defer redisConn.Close()
+
+	// 先载入脚本，之后以 EVALSHA 发送
+	if err := reqIDUpdateScript.Load(redisConn); err != nil {
+		return updated, fillErrors(errs, err)
+	}
+	for i, key := range cacheKeys {
+		reqIDUpdateScript.SendHash(redisConn, k.reqIDUpdateArgs(key, reqIDs[i], ttl)...)
+	}
+	if err := redisConn.Flush(); err != nil {
+		return updated, fillErrors(errs, err)
+	}
+	for i := range cacheKeys {
+		updated[i], errs[i] = redis.Bool(redisConn.Receive())
+	}
+	return updated, errs
 }
@@ -18,20 +18,31 @@ import (
 	"io/ioutil"
 	"strconv"
 	"strings"
+	"sync/atomic"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/heiyeluren/koala/rulefmt"
 )
 
-// RetValue retValue数据类型
+// RetValue retValue数据类型；json 字段名与 [result] 配置、客户端 SDK 一致
+// ErrMsg、StrReason 中可以使用占位符，见 resultTemplate.go
 type RetValue struct {
-	RetType   int32
-	RetCode   int32
-	ErrNo     int32
-	ErrMsg    string
-	StrReason string
-	NeedVcode int32
-	VcodeLen  int32
-	VcodeType int32
-	Other     string
-	Version   int32
+	RetType   int32  `json:"Ret_type"`
+	RetCode   int32  `json:"Ret_code"`
+	ErrNo     int32  `json:"Err_no"`
+	ErrMsg    string `json:"Err_msg"`
+	StrReason string `json:"Str_reason"`
+	NeedVcode int32  `json:"Need_vcode"`
+	VcodeLen  int32  `json:"Vcode_len"`
+	VcodeType int32  `json:"Vcode_type"`
+	Other     string `json:"Other"`
+	Version   int32  `json:"Version"`
+	// 预留 token：浏览带 _reserve=yes 且未超出限制时返回，用于 /rule/commit、/rule/cancel
+	Reservation string `json:"Reservation,omitempty"`
+	*RetQuota          // 限额信息，按需附加；为空时不输出
+
+	template bool // Err_msg、Str_reason 需要填充（含占位符或 {{、}}）；解析 [result] 时确定，见 resultTemplate.go
 }
 
 // Policy .
@@ -41,6 +52,9 @@ type Policy struct {
 	dictsTable    map[string]map[string]string
 	ruleTable     []Rule
 	retValueTable map[int]RetValue
+	source        string      // 规则配置原文，用于版本历史
+	files         []string    // 本策略引用的 rule 文件 + dicts 文件
+	pool          *redis.Pool // 嵌入式 Engine 的连接池；为空时使用全局 RedisPool，与各 rule 一致
 }
 
 /**
@@ -48,12 +62,19 @@ type Policy struct {
  */
 const emptyRunes = " \r\t\v"
 
-var (
-	// GlobalPolicy .全局策略配置
-	GlobalPolicy *Policy
-	// TempPolicy .临时策略配置（用于策略的动态更新）
-	TempPolicy *Policy
-)
+/**
+ * 取一个 redis 连接，用于不属于单条 rule 的缓存操作（如预留记录）；用完需 Close
+ */
+func (p *Policy) redisConn() redis.Conn {
+	if p.pool != nil {
+		return p.pool.Get()
+	}
+	return RedisPool.Get()
+}
+
+// globalPolicy .全局策略配置，保存 *Policy；
+// 策略解析完成后整体替换（原子操作），请求处理过程中读到的策略不会被改动
+var globalPolicy atomic.Value
 
 // NewPolicy Policy构造函数，完成各个元素的空间初始化
 func NewPolicy() *Policy {
@@ -64,11 +85,37 @@ func NewPolicy() *Policy {
 	}
 }
 
-// PolicyInterpreter Policy解释器，用于从文件解析配置，记录到 Policy 结构中
+// CurrentPolicy 返回当前生效的全局策略配置；尚未加载时返回 nil
+// 说明：一次请求的处理过程中应只调用一次，保存为本地策略指针使用，避免前后读到不同的策略
+func CurrentPolicy() *Policy {
+	policy, _ := globalPolicy.Load().(*Policy)
+	return policy
+}
+
+/**
+ * 覆盖全局策略配置
+ */
+func publishPolicy(policy *Policy) {
+	globalPolicy.Store(policy)
+}
+
+// PolicyInterpreter Policy解释器，用于从文件解析配置，记录到 Policy 结构中，并覆盖全局策略配置
 func PolicyInterpreter(extStream string) error {
-	// temp策略缓冲区初始化
-	TempPolicy = NewPolicy()
+	policy, err := PolicyParse(extStream)
+	if err != nil {
+		return err
+	}
+
+	// 覆盖全局策略配置；需要检查更新的文件随策略一起记录于 policy.files
+	publishPolicy(policy)
+
+	return nil
+}
 
+// PolicyParse .
+// 解析并校验策略配置，返回新的 Policy，但不覆盖全局策略配置；
+// extStream 为空时，从 rule_file 配置的文件读取；词表从 [dicts] 中配置的文件读取
+func PolicyParse(extStream string) (*Policy, error) {
 	var rawStream []byte
 	var err error
 	if extStream != "" {
@@ -76,11 +123,39 @@ func PolicyInterpreter(extStream string) error {
 	} else {
 		rawStream, err = ioutil.ReadFile(Config.Get("rule_file"))
 		if err != nil {
-			return errors.New("cannot load rule file")
+			return nil, errors.New("cannot load rule file")
 		}
 	}
 
-	DynamicUpdateFiles = append(DynamicUpdateFiles, Config.Get("rule_file"))
+	files := []string{Config.Get("rule_file")}
+	isJSON := rulefmt.IsJSONFile(Config.Get("rule_file"))
+	policy, err := policyParseStream(rawStream, isJSON, func(dictName, fileName string) ([]byte, error) {
+		files = append(files, fileName)
+		return ioutil.ReadFile(fileName)
+	})
+	if err != nil {
+		return nil, err
+	}
+	policy.files = files
+	return policy, nil
+}
+
+// dictReader 词表内容读取函数；dictName 为词表名，fileName 为 [dicts] 中配置的文件名
+type dictReader func(dictName, fileName string) ([]byte, error)
+
+/**
+ * 解析并校验策略配置原文，词表内容通过 readDict 读取
+ * json 格式（isJSON）的配置由 policyParseJSON 直接构造，不经过方括号格式
+ * 解析结果完全保存在新建的 Policy 中，不读写任何全局变量，可并发调用
+ */
+func policyParseStream(rawStream []byte, isJSON bool, readDict dictReader) (*Policy, error) {
+	if isJSON {
+		return policyParseJSON(rawStream, readDict)
+	}
+	policy := NewPolicy()
+
+	var err error
+	policy.source = string(rawStream)
 	lines := strings.Split(string(rawStream), "\n")
 
 	// 配置文件分成三部分 词表、规则和返回结果，起始字符串分别是 [dicts] [rules] [result]
@@ -108,8 +183,8 @@ func PolicyInterpreter(extStream string) error {
 		if line == "" || line[0] == '#' {
 			continue
 		}
-		if err = dictsBuilder(line); err != nil {
-			return errors.New(err.Error() + "  ;AT-LINE-" + strconv.Itoa(index) + "; " + line)
+		if err = policy.dictsBuilder(line, readDict); err != nil {
+			return nil, errors.New(err.Error() + "  ;AT-LINE-" + strconv.Itoa(index) + "; " + line)
 		}
 	}
 
@@ -119,8 +194,8 @@ func PolicyInterpreter(extStream string) error {
 		if line == "" || line[0] == '#' {
 			continue
 		}
-		if err = rulesBuilder(line); err != nil {
-			return errors.New(err.Error() + "  ;AT-LINE-" + strconv.Itoa(index) + "; " + line)
+		if err = policy.rulesBuilder(line); err != nil {
+			return nil, errors.New(err.Error() + "  ;AT-LINE-" + strconv.Itoa(index) + "; " + line)
 		}
 		// println(line)
 	}
@@ -131,35 +206,67 @@ func PolicyInterpreter(extStream string) error {
 		if line == "" || line[0] == '#' {
 			continue
 		}
-		if err = resultsBuilder(line); err != nil {
-			return errors.New(err.Error() + "  ;AT-LINE-" + strconv.Itoa(index) + "; " + line)
+		if err = policy.resultsBuilder(line); err != nil {
+			return nil, errors.New(err.Error() + "  ;AT-LINE-" + strconv.Itoa(index) + "; " + line)
 		}
 	}
 
 	// 校验规则有效性
-	if err = ruleValidityCheck(); err != nil {
-		return err
+	if err = policy.ruleValidityCheck(); err != nil {
+		return nil, err
 	}
 
-	// 覆盖全局策略配置
-	GlobalPolicy = TempPolicy
+	return policy, nil
+}
 
-	return nil
+/**
+ * 解析 json 格式的策略配置：词表、规则、返回结果依次由结构化配置构造，再校验规则有效性
+ */
+func policyParseJSON(rawStream []byte, readDict dictReader) (*Policy, error) {
+	ruleFile, err := rulefmt.ParseJSON(rawStream)
+	if err != nil {
+		return nil, err
+	}
+	policy := NewPolicy()
+	policy.source = string(rawStream)
+
+	for i, dict := range ruleFile.Dicts {
+		if err = policy.addDict(dict.Name, dict.File, readDict); err != nil {
+			return nil, errors.New(err.Error() + "  ;AT-DICT-" + strconv.Itoa(i) + "; " + dict.Name)
+		}
+	}
+	for i := range ruleFile.Rules {
+		var singleRule Rule
+		if err = singleRule.build(&ruleFile.Rules[i], policy.dictsTable); err != nil {
+			return nil, errors.New(err.Error() + "  ;AT-RULE-" + strconv.Itoa(i) + "; " + ruleFile.Rules[i].Bracket())
+		}
+		policy.ruleTable = append(policy.ruleTable, singleRule)
+	}
+	for i, result := range ruleFile.Results {
+		if err = policy.addResult(result.ID, result.Value); err != nil {
+			return nil, errors.New(err.Error() + "  ;AT-RESULT-" + strconv.Itoa(i))
+		}
+	}
+
+	if err = policy.ruleValidityCheck(); err != nil {
+		return nil, err
+	}
+	return policy, nil
 }
 
 /**
- * rule构造器，对单条 rule 进行解析 然后存入 TempPolicy
+ * rule构造器，对单条 rule 进行解析 然后存入 policy；引用的词表须已解析
  */
-func rulesBuilder(rule string) error {
+func (p *Policy) rulesBuilder(rule string) error {
 	// rule : [direct] [qid @ global_qid_whitelist] [time=1; count=0;] [result=1; return=101]
 	parts := strings.SplitN(rule, ":", 2)
 	if len(parts) == 2 && strings.EqualFold(strings.Trim(parts[0], emptyRunes), "rule") {
 		//
 		var singleRule Rule
-		if err := singleRule.Constructor(parts[1]); err != nil {
+		if err := singleRule.Constructor(parts[1], p.dictsTable); err != nil {
 			return err
 		}
-		TempPolicy.ruleTable = append(TempPolicy.ruleTable, singleRule)
+		p.ruleTable = append(p.ruleTable, singleRule)
 	} else {
 		return errors.New("rule syntax error: struct error")
 	}
@@ -167,9 +274,9 @@ func rulesBuilder(rule string) error {
 }
 
 /**
- * dicts构造器，对单条 dict 进行解析 然后存入 TempPolicy
+ * dicts构造器，对单条 dict 进行解析 然后存入 policy
  */
-func dictsBuilder(dict string) error {
+func (p *Policy) dictsBuilder(dict string, readDict dictReader) error {
 	// 配置格式 名称 : 配置文件名
 	// global_qid_whitelist : etc/global_qid_whitelist.dat
 
@@ -177,12 +284,17 @@ func dictsBuilder(dict string) error {
 	if len(parts) != 2 {
 		return errors.New("dict syntax error: struct error")
 	}
+	return p.addDict(strings.Trim(parts[0], emptyRunes), strings.Trim(parts[1], emptyRunes), readDict)
+}
+
+/**
+ * 读取词表内容并存入 policy
+ */
+func (p *Policy) addDict(dictName string, fileName string, readDict dictReader) error {
 	oneDict := make(map[string]string, 10)
 
 	// 读取配置文件
-	fileName := strings.Trim(parts[1], emptyRunes)
-	DynamicUpdateFiles = append(DynamicUpdateFiles, fileName)
-	rawStream, err := ioutil.ReadFile(fileName)
+	rawStream, err := readDict(dictName, fileName)
 	if err != nil {
 		return errors.New("cannot load dict file")
 	}
@@ -191,44 +303,53 @@ func dictsBuilder(dict string) error {
 		item := strings.Trim(v, emptyRunes)
 		oneDict[item] = item
 	}
-	dictName := strings.Trim(parts[0], emptyRunes)
-	TempPolicy.dictsTable[dictName] = oneDict
+	p.dictsTable[dictName] = oneDict
 	return nil
 }
 
 /**
- * retValue 构造器，对单条 result 进行解析
+ * retValue 构造器，对单条 result 进行解析 然后存入 policy
  */
-func resultsBuilder(result string) error {
+func (p *Policy) resultsBuilder(result string) error {
 	// 1 : { "Ret_type":1, "Ret_code" : 0, "Err_no":0, "Err_msg":"", "Str_reason":"Allow", "Need_vcode":0, "Vcode_len":0, "Vcode_type":0, "Other":"", "Version":0 }
 	parts := strings.SplitN(result, ":", 2)
-	var retType = -1
-	var err error
-	if retType, err = strconv.Atoi(strings.Trim(parts[0], emptyRunes)); err != nil {
+	if len(parts) != 2 {
+		return errors.New("result syntax error: struct error")
+	}
+	retType, err := strconv.Atoi(strings.Trim(parts[0], emptyRunes))
+	if err != nil {
 		return err
 	}
+	return p.addResult(retType, []byte(strings.Trim(parts[1], emptyRunes)))
+}
 
+/**
+ * 解析单个返回结果（json）并存入 policy
+ */
+func (p *Policy) addResult(retType int, value []byte) error {
 	var ret RetValue
-	inString := strings.Trim(parts[1], emptyRunes)
-	if err = json.Unmarshal([]byte(inString), &ret); err != nil {
+	if err := json.Unmarshal(value, &ret); err != nil {
+		return err
+	}
+	if err := ret.checkTemplate(); err != nil {
 		return err
 	}
 	// fmt.Printf("%+v \n", ret)
-	TempPolicy.retValueTable[retType] = ret
+	p.retValueTable[retType] = ret
 	return nil
 }
 
 // ruleValidityCheck .
 // 功能：rule合法性检查（事后检查）
-// 对象：TempPolicy
+// 对象：解析中的 policy
 // 作用：此检查发生在，解析过程的末尾，对已经读入内存的配置，检查其合法性、逻辑正确性
 //       a、return值 唯一性检查
 //       b、base、count、time、result、return完整性检查
 //       c、base、count、time、result、return的范围检查，如 0 值、负值等
-func ruleValidityCheck() error {
+func (p *Policy) ruleValidityCheck() error {
 	var returnMap = make(map[int32]string)
 
-	for _, singleRule := range TempPolicy.ruleTable {
+	for _, singleRule := range p.ruleTable {
 		switch singleRule.method {
 		case "direct":
 			break
@@ -247,7 +368,7 @@ func ruleValidityCheck() error {
 			return errors.New("rule semantic error: result invalid")
 		}
 
-		if _, OK := TempPolicy.retValueTable[int(singleRule.result)]; !OK {
+		if _, OK := p.retValueTable[int(singleRule.result)]; !OK {
 			return errors.New("rule semantic error: result type no found")
 		}
 
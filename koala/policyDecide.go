@@ -0,0 +1,410 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Policy decision logic
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koala
+
+import (
+	"context"
+
+	"github.com/heiyeluren/koala/utility"
+)
+
+// 判定逻辑：http 等前端接口与嵌入式 Engine 共用
+// 缓存查询出错的 rule 记录日志，按未超出限制处理；同时返回首个错误，供调用方决定是否采用结果
+// hook 不为空时，对每条匹配的 rule 调用，记录判定统计、发送判定事件（见 recordDecision）
+
+// decisionHook 每条匹配 rule 的判定回调；rule 只在回调期间有效
+type decisionHook func(rule *Rule, cacheKey string, params map[string]string, isOut bool)
+
+/**
+ * 查询：按顺序匹配每条 rule，首个超出限制的 rule 决定结果
+ */
+func (p *Policy) browse(ctx context.Context, params map[string]string, withQuota bool, hook decisionHook, logHandle *utility.Logger) (RetValue, error) {
+	var singleRule Rule
+	var firstErr error
+	var retValue = p.retValueTable[0]
+	var decided bool
+	// 限额信息：判定结果的 rule 给出；未超出限制时，取所有匹配 rule 中最紧的一个
+	var quota *RetQuota
+	// 匹配每一条rule规则
+	for _, singleRule = range p.ruleTable {
+		if err := ctx.Err(); err != nil {
+			return retValue, err
+		}
+		if !singleRule.satisfied(params) {
+			continue
+		}
+
+		// 对命中的key，查缓存值，与阀值比较，判断是否超出限制
+		ruleCacheKey := singleRule.getCacheKey(params)
+		isOut, err := singleRule.browse(ruleCacheKey)
+		if err != nil {
+			logHandle.Fatal("[errmsg=" + err.Error() + "]")
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		// 统计，记录策略判定数据、判定事件
+		if hook != nil {
+			hook(&singleRule, ruleCacheKey, params, isOut)
+		}
+
+		// 限额信息、结果模板需要 rule 的缓存状态，按需读取
+		var state *RuleState
+		if withQuota || (isOut && p.retValueTable[int(singleRule.result)].hasTemplate()) {
+			state = ruleState(&singleRule, ruleCacheKey, logHandle)
+		}
+		if withQuota {
+			if isOut {
+				quota = singleRule.retQuota(state, true)
+			} else {
+				quota = tighterQuota(quota, singleRule.retQuota(state, false))
+			}
+		}
+
+		// 超出限制，按照rule的约定，给出处置策略
+		if isOut {
+			retValue = p.retValueTable[int(singleRule.result)]
+			retValue.RetCode = singleRule.returnCode
+			retValue.render(&singleRule, state, params)
+			decided = true
+			break
+		}
+		retValue = p.retValueTable[1]
+	}
+	if !decided {
+		retValue.render(nil, nil, params)
+	}
+	retValue.RetQuota = quota
+	return retValue, firstErr
+}
+
+/**
+ * 完全查询：返回所有超出限制的 rule 的结果；均未超出时，返回一个默认结果
+ */
+func (p *Policy) browseComplete(ctx context.Context, params map[string]string, withQuota bool, hook decisionHook, logHandle *utility.Logger) ([]RetValue, error) {
+	var singleRule Rule
+	var firstErr error
+	// 用于返回多个结果，RetValue数组
+	var retArray []RetValue
+	var retValue = p.retValueTable[0]
+	// 匹配每一条rule规则
+	for _, singleRule = range p.ruleTable {
+		if err := ctx.Err(); err != nil {
+			return retArray, err
+		}
+		if !singleRule.satisfied(params) {
+			continue
+		}
+
+		// 对匹配的key，查缓存值，与阀值比较，判断是否超出限制
+		ruleCacheKey := singleRule.getCacheKey(params)
+		isOut, err := singleRule.browse(ruleCacheKey)
+		if err != nil {
+			logHandle.Fatal("[errmsg=" + err.Error() + "]")
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		// 统计，记录策略判定数据、判定事件
+		if hook != nil {
+			hook(&singleRule, ruleCacheKey, params, isOut)
+		}
+
+		// 命中，拼装结果；限额信息每个命中的 rule 各自给出
+		if isOut {
+			retValue = p.retValueTable[int(singleRule.result)]
+			retValue.RetCode = singleRule.returnCode
+			if withQuota || retValue.hasTemplate() {
+				state := ruleState(&singleRule, ruleCacheKey, logHandle)
+				retValue.render(&singleRule, state, params)
+				if withQuota {
+					retValue.RetQuota = singleRule.retQuota(state, true)
+				}
+			}
+			retArray = append(retArray, retValue)
+		}
+	}
+
+	// 如果没有命中任何策略，返回默认值
+	if retValue.RetType == 0 {
+		retValue.render(nil, nil, params)
+		retArray = append(retArray, retValue)
+	}
+	return retArray, firstErr
+}
+
+/**
+ * 更新：对每条匹配的 rule 更新计数；返回每条更新了计数的 rule 的结果（direct 等无需更新的 rule 不在其中）
+ * 带 _reqid 参数时为幂等更新：reqid_ttl 秒内同一 _reqid 的重复更新跳过（Duplicate），更新失败的 rule 可以重试
+ * 幂等更新的标记与计数在同一脚本中完成，不会出现只有标记、没有计数的情况
+ */
+func (p *Policy) update(ctx context.Context, params map[string]string, logHandle *utility.Logger) ([]ruleUpdateResult, error) {
+	results := []ruleUpdateResult{}
+	reqID := params["_reqid"]
+	// 匹配每一条rule规则
+	var singleRule Rule
+	for _, singleRule = range p.ruleTable {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		if !singleRule.satisfied(params) {
+			continue
+		}
+
+		if !singleRule.updatable() {
+			continue
+		}
+		ruleCacheKey := singleRule.getCacheKey(params)
+		one := ruleUpdateResult{Return: singleRule.returnCode, Method: singleRule.method}
+		// 幂等更新：已标记过的跳过
+		if reqID != "" {
+			updated, err := singleRule.updateOnce(ruleCacheKey, reqID, reqIDTTL())
+			if err != nil {
+				logHandle.Fatal("[errmsg=" + err.Error() + " cachekey=" + ruleCacheKey + " reqid=" + reqID + "]")
+				one.Error = err.Error()
+			} else {
+				one.OK, one.Duplicate = true, !updated
+			}
+			results = append(results, one)
+			continue
+		}
+
+		// 更新cache值
+		var err error
+		switch singleRule.method {
+		case "count":
+			err = singleRule.countUpdate(ruleCacheKey)
+		case "base":
+			err = singleRule.baseUpdate(ruleCacheKey)
+		case "leak":
+			err = singleRule.leakUpdate(ruleCacheKey)
+		default:
+		}
+		one.OK = err == nil
+		if err != nil {
+			logHandle.Fatal("[errmsg=" + err.Error() + " cachekey=" + ruleCacheKey + "]")
+			one.Error = err.Error()
+		}
+		results = append(results, one)
+	}
+	return results, nil
+}
+
+/**
+ * 多重更新：逐条 rule，对匹配的 job 批量更新；匹配与更新规则同 update
+ * 带 _reqid 的 job 为幂等更新，标记与计数在同一脚本中完成；返回的结果与 jobs 一一对应
+ */
+func (p *Policy) multiUpdate(jobs []Job, logHandle *utility.Logger) []JobUpdateResult {
+	results := make([]JobUpdateResult, len(jobs))
+	for i, job := range jobs {
+		results[i] = JobUpdateResult{ID: job.ID, Status: true, Updated: []int32{}, Failed: []int32{}, Duplicate: []int32{}}
+	}
+
+	for r := range p.ruleTable {
+		singleRule := &p.ruleTable[r]
+		if !singleRule.updatable() {
+			continue
+		}
+		// 不带 _reqid 的 job 直接更新，带 _reqid 的 job 幂等更新
+		var cacheKeys, onceKeys, reqIDs []string
+		var jobIndexes, onceIndexes []int
+		for i, job := range jobs {
+			if !singleRule.satisfied(job.args) {
+				continue
+			}
+			if reqID := job.args["_reqid"]; reqID != "" {
+				onceKeys = append(onceKeys, singleRule.getCacheKey(job.args))
+				reqIDs = append(reqIDs, reqID)
+				onceIndexes = append(onceIndexes, i)
+				continue
+			}
+			cacheKeys = append(cacheKeys, singleRule.getCacheKey(job.args))
+			jobIndexes = append(jobIndexes, i)
+		}
+
+		if len(onceKeys) > 0 {
+			updated, errs := singleRule.multiUpdateOnce(onceKeys, reqIDs, reqIDTTL())
+			for n, i := range onceIndexes {
+				switch {
+				case errs[n] != nil:
+					logHandle.Fatal("[errmsg=" + errs[n].Error() + " cachekey=" + onceKeys[n] + " reqid=" + reqIDs[n] + "]")
+					results[i].Status = false
+					results[i].Failed = append(results[i].Failed, singleRule.returnCode)
+				case !updated[n]:
+					results[i].Duplicate = append(results[i].Duplicate, singleRule.returnCode)
+				default:
+					results[i].Updated = append(results[i].Updated, singleRule.returnCode)
+				}
+			}
+		}
+		if len(cacheKeys) == 0 {
+			continue
+		}
+
+		var errs []error
+		switch singleRule.method {
+		case "count":
+			errs = singleRule.multiCountUpdate(cacheKeys)
+		case "base":
+			errs = singleRule.multiBaseUpdate(cacheKeys)
+		case "leak":
+			errs = singleRule.multiLeakUpdate(cacheKeys)
+		default:
+			continue
+		}
+		for n, i := range jobIndexes {
+			if errs[n] != nil {
+				logHandle.Fatal("[errmsg=" + errs[n].Error() + " cachekey=" + cacheKeys[n] + "]")
+				results[i].Status = false
+				results[i].Failed = append(results[i].Failed, singleRule.returnCode)
+				continue
+			}
+			results[i].Updated = append(results[i].Updated, singleRule.returnCode)
+		}
+	}
+	return results
+}
+
+/**
+ * 多重查询：逐条 rule，对尚未判定的 job 批量查询缓存；判定过程与 browse 对每个 job 单独查询完全一致
+ * 返回的结果与 buffers 一一对应
+ */
+func (p *Policy) multiBrowse(ctx context.Context, buffers []JobBuffer, hook decisionHook, logHandle *utility.Logger) ([]RetValue, error) {
+	var firstErr error
+	for r := range p.ruleTable {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		singleRule := &p.ruleTable[r]
+		var cacheKeys []interface{}
+		for i, buf := range buffers {
+			buffers[i].key = ""
+			if buf.status {
+				continue
+			}
+			if singleRule.satisfied(buf.args) {
+				buffers[i].key = singleRule.getCacheKey(buf.args)
+				cacheKeys = append(cacheKeys, buffers[i].key)
+			}
+		}
+
+		if len(cacheKeys) == 0 {
+			continue
+		}
+
+		var multiResult map[string]bool
+		var err error
+		switch singleRule.method {
+		case "direct":
+			multiResult, err = singleRule.multiDirectBrowse(cacheKeys)
+		case "count":
+			multiResult, err = singleRule.multiCountBrowse(cacheKeys)
+		case "base":
+			multiResult, err = singleRule.multiBaseBrowse(cacheKeys)
+		case "leak":
+			multiResult, err = singleRule.multiLeakBrowse(cacheKeys)
+		default:
+		}
+		// 与 browse 一致：缓存查询出错时，记录日志，按未超出限制处理
+		if err != nil {
+			logHandle.Fatal("[errmsg=" + err.Error() + "]")
+			if firstErr == nil {
+				firstErr = err
+			}
+			multiResult = nil
+		}
+
+		// 限额信息需要 rule 的缓存状态：与判定一样，同一条 rule 的全部 job 一次读取
+		var states map[string]*RuleState
+		var quotaKeys []string
+		for _, buf := range buffers {
+			if buf.key != "" && buf.withQuota {
+				quotaKeys = append(quotaKeys, buf.key)
+			}
+		}
+		if len(quotaKeys) > 0 {
+			states = ruleStates(singleRule, quotaKeys, logHandle)
+		}
+
+		for i, buf := range buffers {
+			if buf.key == "" {
+				continue
+			}
+			isOut := multiResult[buf.key]
+
+			// 统计，记录策略判定数据、判定事件；每个 job 各计一次
+			if hook != nil {
+				hook(singleRule, buf.key, buf.args, isOut)
+			}
+
+			if buf.withQuota {
+				state := states[buf.key]
+				if isOut {
+					buffers[i].quota = singleRule.retQuota(state, true)
+				} else {
+					buffers[i].quota = tighterQuota(buf.quota, singleRule.retQuota(state, false))
+				}
+			}
+
+			if isOut {
+				buffers[i].status = true
+				buffers[i].decision = int(singleRule.result)
+				buffers[i].retCode = singleRule.returnCode
+				buffers[i].rule = singleRule
+				buffers[i].ruleKey = buf.key
+			} else {
+				buffers[i].decision = 1
+			}
+		}
+	}
+
+	// 结果模板需要判定结果的 rule 的缓存状态：按 rule 分组，每条 rule 一次读取
+	templateKeys := make(map[*Rule][]string)
+	for _, buf := range buffers {
+		if buf.rule != nil && p.retValueTable[buf.decision].hasTemplate() {
+			templateKeys[buf.rule] = append(templateKeys[buf.rule], buf.ruleKey)
+		}
+	}
+	templateStates := make(map[*Rule]map[string]*RuleState, len(templateKeys))
+	for rule, keys := range templateKeys {
+		templateStates[rule] = ruleStates(rule, keys, logHandle)
+	}
+
+	results := make([]RetValue, 0, len(buffers))
+	for _, buf := range buffers {
+		result := p.retValueTable[buf.decision]
+		result.RetCode = buf.retCode
+		if result.hasTemplate() {
+			var state *RuleState
+			if buf.rule != nil {
+				state = templateStates[buf.rule][buf.ruleKey]
+			}
+			result.render(buf.rule, state, buf.args)
+		}
+		result.RetQuota = buf.quota
+		results = append(results, result)
+	}
+	return results, firstErr
+}
+
+/**
+ * 幂等更新标记的有效期（秒）：reqid_ttl 配置，默认 300
+ */
+func reqIDTTL() int {
+	if ttl := Config.GetInt("reqid_ttl"); ttl > 0 {
+		return ttl
+	}
+	return 300
+}
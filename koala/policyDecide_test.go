@@ -0,0 +1,172 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Policy decide tests
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koala
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/heiyeluren/koala/utility"
+)
+
+// 测试用的规则：count、base、leak 各一条
+const testDecideRules = "[rules]\n" +
+	"rule : [count] [act=ask; uid=+;] [time=60; count=2;] [result=2; return=201]\n" +
+	"rule : [base] [act=post; uid=+;] [base=1; time=60; count=1;] [result=2; return=202]\n" +
+	"rule : [leak] [act=like; uid=+;] [time=60; count=1;] [result=2; return=203]\n" + testPolicyResults
+
+func TestMultiBrowseQuota(t *testing.T) {
+	_, engine := testRedisEngine(t, testDecideRules)
+	ctx := context.Background()
+
+	// 各 uid 已计数的次数不同：有的未超出限制，有的已超出
+	updates := map[string]int{"ask|u1": 1, "ask|u2": 2, "post|u1": 1, "post|u2": 3, "like|u1": 1, "like|u2": 2}
+	jobs := []map[string]string{}
+	for _, act := range []string{"ask", "post", "like"} {
+		for _, uid := range []string{"u1", "u2", "u3"} {
+			params := map[string]string{"act": act, "uid": uid}
+			for n := 0; n < updates[act+"|"+uid]; n++ {
+				if err := engine.Update(ctx, params); err != nil {
+					t.Fatal(err)
+				}
+			}
+			jobs = append(jobs, map[string]string{"act": act, "uid": uid, "_quota": "yes"})
+		}
+	}
+	// 没有匹配的规则、不带限额信息的 job
+	jobs = append(jobs, map[string]string{"act": "read", "uid": "u1", "_quota": "yes"}, map[string]string{"act": "ask", "uid": "u2"})
+
+	results, err := engine.MultiBrowse(ctx, jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(jobs) {
+		t.Fatalf("want %d results, got %d", len(jobs), len(results))
+	}
+	denied := []int32{}
+	for _, result := range results {
+		if result.RetType == 2 {
+			denied = append(denied, result.RetCode)
+		}
+	}
+	if !reflect.DeepEqual(denied, []int32{201, 202, 203, 201}) {
+		t.Errorf("denied rules: %v", denied)
+	}
+	// 多重查询的结果（含限额信息）与逐个查询一致
+	for i, job := range jobs {
+		want, err := engine.Browse(ctx, job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(results[i], want) {
+			t.Errorf("job %v:\nmulti  %+v %+v\nsingle %+v %+v", job, results[i], results[i].RetQuota, want, want.RetQuota)
+		}
+	}
+}
+
+func TestMultiUpdateReqID(t *testing.T) {
+	mr, engine := testRedisEngine(t, testDecideRules)
+	policy := engine.policy
+	logHandle := utility.NewLogger("")
+	job := func(id string, args map[string]string) Job {
+		return Job{ID: id, args: args}
+	}
+	ask := func(uid, reqID string) map[string]string {
+		args := map[string]string{"act": "ask", "uid": uid}
+		if reqID != "" {
+			args["_reqid"] = reqID
+		}
+		return args
+	}
+
+	rounds := []struct {
+		name string
+		jobs []Job
+		want []JobUpdateResult
+	}{
+		{
+			name: "first",
+			jobs: []Job{job("1", ask("u1", "r1")), job("2", ask("u1", "")), job("3", ask("u2", "r1")), job("4", map[string]string{"act": "read", "uid": "u1", "_reqid": "r1"})},
+			want: []JobUpdateResult{
+				{ID: "1", Status: true, Updated: []int32{201}, Failed: []int32{}, Duplicate: []int32{}},
+				{ID: "2", Status: true, Updated: []int32{201}, Failed: []int32{}, Duplicate: []int32{}},
+				{ID: "3", Status: true, Updated: []int32{201}, Failed: []int32{}, Duplicate: []int32{}},
+				{ID: "4", Status: true, Updated: []int32{}, Failed: []int32{}, Duplicate: []int32{}},
+			},
+		},
+		{
+			// 同一 _reqid 重复更新跳过；同一批次中重复的 _reqid 只更新一次；不带 _reqid 的总是更新
+			name: "retry",
+			jobs: []Job{job("1", ask("u1", "r1")), job("2", ask("u1", "")), job("3", ask("u2", "r2")), job("5", ask("u2", "r2"))},
+			want: []JobUpdateResult{
+				{ID: "1", Status: true, Updated: []int32{}, Failed: []int32{}, Duplicate: []int32{201}},
+				{ID: "2", Status: true, Updated: []int32{201}, Failed: []int32{}, Duplicate: []int32{}},
+				{ID: "3", Status: true, Updated: []int32{201}, Failed: []int32{}, Duplicate: []int32{}},
+				{ID: "5", Status: true, Updated: []int32{}, Failed: []int32{}, Duplicate: []int32{201}},
+			},
+		},
+	}
+	for _, round := range rounds {
+		results := policy.multiUpdate(round.jobs, logHandle)
+		if !reflect.DeepEqual(results, round.want) {
+			t.Errorf("%s:\nwant %+v\ngot  %+v", round.name, round.want, results)
+		}
+	}
+
+	u1 := policy.ruleTable[0].getCacheKey(ask("u1", ""))
+	u2 := policy.ruleTable[0].getCacheKey(ask("u2", ""))
+	for key, want := range map[string]string{u1: "3", u2: "2"} {
+		if got, _ := mr.Get(key); got != want {
+			t.Errorf("count of %s: want %s, got %s", key, want, got)
+		}
+	}
+
+	// 单个更新与多重更新共用标记：已经更新过的 _reqid 跳过
+	results, err := policy.update(context.Background(), ask("u1", "r1"), logHandle)
+	if err != nil || len(results) != 1 || !results[0].OK || !results[0].Duplicate {
+		t.Errorf("update with used reqid: want duplicate, got %+v, %v", results, err)
+	}
+	results, err = policy.update(context.Background(), ask("u1", "r3"), logHandle)
+	if err != nil || len(results) != 1 || !results[0].OK || results[0].Duplicate {
+		t.Errorf("update with new reqid: want updated, got %+v, %v", results, err)
+	}
+	if got, _ := mr.Get(u1); got != "4" {
+		t.Errorf("count of %s after update: want 4, got %s", u1, got)
+	}
+}
+
+func TestUpdateReqIDFailure(t *testing.T) {
+	mr, engine := testRedisEngine(t, testDecideRules)
+	policy := engine.policy
+	params := map[string]string{"act": "ask", "uid": "u1", "_reqid": "r1"}
+	cacheKey := policy.ruleTable[0].getCacheKey(params)
+
+	// 计数 key 类型错误，更新失败：不留下标记，修复后重试可以更新
+	mr.Lpush(cacheKey, "x")
+	results := policy.multiUpdate([]Job{{ID: "1", args: params}}, utility.NewLogger(""))
+	if results[0].Status || !reflect.DeepEqual(results[0].Failed, []int32{201}) {
+		t.Fatalf("want failed update, got %+v", results[0])
+	}
+	if mr.Exists(cacheKey + ReqIDKeySuffix + "r1") {
+		t.Fatalf("reqid marked after failed update")
+	}
+	mr.Del(cacheKey)
+	results = policy.multiUpdate([]Job{{ID: "1", args: params}}, utility.NewLogger(""))
+	if !results[0].Status || !reflect.DeepEqual(results[0].Updated, []int32{201}) {
+		t.Errorf("retry: want updated, got %+v", results[0])
+	}
+	if got, _ := mr.Get(cacheKey); got != "1" {
+		t.Errorf("count after retry: want 1, got %s", got)
+	}
+}
@@ -0,0 +1,253 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Policy diff
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koala
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/heiyeluren/koala/utility"
+)
+
+// RuleChange 单条 rule 的变化；rule 以 return 值唯一标识
+type RuleChange struct {
+	Return int32  `json:"return"`
+	OldPos int    `json:"old_pos,omitempty"`
+	NewPos int    `json:"new_pos,omitempty"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+}
+
+// DictChange 单个词表的变化；Status 为 added、removed 或 changed
+type DictChange struct {
+	Name    string   `json:"name"`
+	Status  string   `json:"status"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// ResultChange 单个返回结果配置的变化；Old 为空表示新增，New 为空表示删除
+type ResultChange struct {
+	ID  int       `json:"id"`
+	Old *RetValue `json:"old,omitempty"`
+	New *RetValue `json:"new,omitempty"`
+}
+
+// PolicyDiff 两个策略之间的差异
+type PolicyDiff struct {
+	RulesAdded     []RuleChange   `json:"rules_added"`
+	RulesRemoved   []RuleChange   `json:"rules_removed"`
+	RulesChanged   []RuleChange   `json:"rules_changed"`
+	DictsChanged   []DictChange   `json:"dicts_changed"`
+	ResultsChanged []ResultChange `json:"results_changed"`
+}
+
+// DictChangeCount 单个词表变化的条目数
+type DictChangeCount struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Added   int    `json:"added"`
+	Removed int    `json:"removed"`
+}
+
+// PolicyDiffCount 差异的数量统计，不含 rule 原文和词表条目；未认证的 /policy/diff 只返回此项
+type PolicyDiffCount struct {
+	RulesAdded     int               `json:"rules_added"`
+	RulesRemoved   int               `json:"rules_removed"`
+	RulesChanged   int               `json:"rules_changed"`
+	DictsChanged   []DictChangeCount `json:"dicts_changed"`
+	ResultsChanged int               `json:"results_changed"`
+}
+
+// DiffPolicy .
+// 比较新旧两个策略，给出 rule 的增加、删除、变化（阀值、keys、result 或者优先级位置），
+// 词表条目的增加、删除，以及返回结果配置的变化
+// 位置 pos 从 1 开始计数；oldPolicy 为 nil 时，全部视为新增
+func DiffPolicy(oldPolicy, newPolicy *Policy) *PolicyDiff {
+	diff := &PolicyDiff{
+		RulesAdded:     []RuleChange{},
+		RulesRemoved:   []RuleChange{},
+		RulesChanged:   []RuleChange{},
+		DictsChanged:   []DictChange{},
+		ResultsChanged: []ResultChange{},
+	}
+	if oldPolicy == nil {
+		oldPolicy = NewPolicy()
+	}
+
+	oldRules := make(map[int32]int)
+	for i := range oldPolicy.ruleTable {
+		oldRules[oldPolicy.ruleTable[i].returnCode] = i
+	}
+	newRules := make(map[int32]int)
+	for i := range newPolicy.ruleTable {
+		newRules[newPolicy.ruleTable[i].returnCode] = i
+	}
+
+	for i := range newPolicy.ruleTable {
+		newRule := &newPolicy.ruleTable[i]
+		j, OK := oldRules[newRule.returnCode]
+		if !OK {
+			diff.RulesAdded = append(diff.RulesAdded, RuleChange{Return: newRule.returnCode, NewPos: i + 1, New: newRule.dump()})
+			continue
+		}
+		oldRule := &oldPolicy.ruleTable[j]
+		if oldRule.dump() != newRule.dump() || i != j {
+			diff.RulesChanged = append(diff.RulesChanged, RuleChange{
+				Return: newRule.returnCode,
+				OldPos: j + 1,
+				NewPos: i + 1,
+				Old:    oldRule.dump(),
+				New:    newRule.dump(),
+			})
+		}
+	}
+
+	for j := range oldPolicy.ruleTable {
+		oldRule := &oldPolicy.ruleTable[j]
+		if _, OK := newRules[oldRule.returnCode]; !OK {
+			diff.RulesRemoved = append(diff.RulesRemoved, RuleChange{Return: oldRule.returnCode, OldPos: j + 1, Old: oldRule.dump()})
+		}
+	}
+
+	diff.DictsChanged = diffDicts(oldPolicy.dictsTable, newPolicy.dictsTable)
+	diff.ResultsChanged = diffResults(oldPolicy.retValueTable, newPolicy.retValueTable)
+	return diff
+}
+
+/**
+ * 词表比较，给出每个词表增加、删除的条目
+ */
+func diffDicts(oldDicts, newDicts map[string]map[string]string) []DictChange {
+	names := make([]string, 0, len(oldDicts)+len(newDicts))
+	for name := range oldDicts {
+		names = append(names, name)
+	}
+	for name := range newDicts {
+		if _, OK := oldDicts[name]; !OK {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []DictChange{}
+	for _, name := range names {
+		oldDict, inOld := oldDicts[name]
+		newDict, inNew := newDicts[name]
+		change := DictChange{Name: name, Status: "changed"}
+		switch {
+		case !inOld:
+			change.Status = "added"
+		case !inNew:
+			change.Status = "removed"
+		}
+		change.Added = dictMinus(newDict, oldDict)
+		change.Removed = dictMinus(oldDict, newDict)
+		if change.Status == "changed" && len(change.Added) == 0 && len(change.Removed) == 0 {
+			continue
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+/**
+ * 词表差集 a - b；忽略空行条目
+ */
+func dictMinus(a, b map[string]string) []string {
+	items := []string{}
+	for item := range a {
+		if _, OK := b[item]; !OK && item != "" {
+			items = append(items, item)
+		}
+	}
+	sort.Strings(items)
+	return items
+}
+
+/**
+ * 返回结果配置比较
+ */
+func diffResults(oldResults, newResults map[int]RetValue) []ResultChange {
+	ids := make([]int, 0, len(oldResults)+len(newResults))
+	for id := range oldResults {
+		ids = append(ids, id)
+	}
+	for id := range newResults {
+		if _, OK := oldResults[id]; !OK {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	changes := []ResultChange{}
+	for _, id := range ids {
+		oldValue, inOld := oldResults[id]
+		newValue, inNew := newResults[id]
+		if inOld && inNew && oldValue == newValue {
+			continue
+		}
+		change := ResultChange{ID: id}
+		if inOld {
+			change.Old = &oldValue
+		}
+		if inNew {
+			change.New = &newValue
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// Empty 判断是否没有任何变化
+func (d *PolicyDiff) Empty() bool {
+	return len(d.RulesAdded) == 0 && len(d.RulesRemoved) == 0 && len(d.RulesChanged) == 0 &&
+		len(d.DictsChanged) == 0 && len(d.ResultsChanged) == 0
+}
+
+// Count 统计差异的数量
+func (d *PolicyDiff) Count() *PolicyDiffCount {
+	count := &PolicyDiffCount{
+		RulesAdded:     len(d.RulesAdded),
+		RulesRemoved:   len(d.RulesRemoved),
+		RulesChanged:   len(d.RulesChanged),
+		DictsChanged:   make([]DictChangeCount, 0, len(d.DictsChanged)),
+		ResultsChanged: len(d.ResultsChanged),
+	}
+	for _, c := range d.DictsChanged {
+		count.DictsChanged = append(count.DictsChanged, DictChangeCount{Name: c.Name, Status: c.Status, Added: len(c.Added), Removed: len(c.Removed)})
+	}
+	return count
+}
+
+// String 输出 json 格式的差异，用于日志
+func (d *PolicyDiff) String() string {
+	stream, err := json.Marshal(d)
+	if err != nil {
+		return ""
+	}
+	return string(stream)
+}
+
+/**
+ * 策略替换后，将差异写入 trace 日志，便于把线上问题和配置变更对应起来
+ * 首次加载没有差异（diff 为 nil），不记录
+ */
+func policyDiffTrace(v *PolicyVersion, diff *PolicyDiff, by string, logHandle *utility.Logger) {
+	if diff == nil {
+		return
+	}
+	logHandle.Trace("[msg=policy diff version=" + strconv.FormatInt(v.Version, 10) + " origin=" + v.Origin +
+		" by=" + by + " diff=" + diff.String() + "]")
+}
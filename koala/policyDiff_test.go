@@ -0,0 +1,162 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Policy diff tests
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koala
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// 测试用的策略配置：两条 count 规则，一条引用词表的 direct 规则
+const testDiffBase = "[dicts]\nglobal_uid_whitelist : conf/global_uid_whitelist.dat\n[rules]\n" +
+	"rule : [direct] [uid @ global_uid_whitelist] [time=1; count=0;] [result=1; return=101]\n" +
+	"rule : [count] [act=ask; uid=+;] [time=10; count=2;] [result=2; return=201]\n" +
+	"rule : [count] [act=post; uid=+;] [time=10; count=2;] [result=2; return=202]\n" + testPolicyResults
+
+/**
+ * 按给定的词表内容解析策略配置
+ */
+func testDiffPolicy(t *testing.T, stream string, whitelist string) *Policy {
+	policy, err := policyParseStream([]byte(stream), false, func(dictName, fileName string) ([]byte, error) {
+		return []byte(whitelist), nil
+	})
+	if err != nil {
+		t.Fatalf("parse policy: %v", err)
+	}
+	return policy
+}
+
+/**
+ * 把差异整理成便于比较的文字；rule 带 return 值和位置
+ */
+func testDiffSummary(diff *PolicyDiff) []string {
+	lines := []string{}
+	for _, c := range diff.RulesAdded {
+		lines = append(lines, "rule+ "+strconv.Itoa(int(c.Return))+" @"+strconv.Itoa(c.NewPos))
+	}
+	for _, c := range diff.RulesRemoved {
+		lines = append(lines, "rule- "+strconv.Itoa(int(c.Return))+" @"+strconv.Itoa(c.OldPos))
+	}
+	for _, c := range diff.RulesChanged {
+		lines = append(lines, "rule~ "+strconv.Itoa(int(c.Return))+" @"+strconv.Itoa(c.OldPos)+"->"+strconv.Itoa(c.NewPos))
+	}
+	for _, c := range diff.DictsChanged {
+		lines = append(lines, "dict "+c.Name+" "+c.Status+" +"+strings.Join(c.Added, ",")+" -"+strings.Join(c.Removed, ","))
+	}
+	for _, c := range diff.ResultsChanged {
+		lines = append(lines, "result "+strconv.Itoa(c.ID)+" old="+strconv.FormatBool(c.Old != nil)+" new="+strconv.FormatBool(c.New != nil))
+	}
+	return lines
+}
+
+func TestDiffPolicy(t *testing.T) {
+	cases := []struct {
+		name         string
+		old          string // 为空时比较 nil 旧策略
+		oldWhitelist string
+		new          string
+		newWhitelist string
+		want         []string
+	}{
+		{
+			name: "same", old: testDiffBase, oldWhitelist: "10001\n10002\n",
+			new: testDiffBase, newWhitelist: "10001\n10002\n",
+			want: []string{},
+		},
+		{
+			name: "nil old policy",
+			new:  testDiffBase, newWhitelist: "10001\n",
+			want: []string{"rule+ 101 @1", "rule+ 201 @2", "rule+ 202 @3", "dict global_uid_whitelist added +10001 -", "result 1 old=false new=true", "result 2 old=false new=true"},
+		},
+		{
+			name: "threshold changed", old: testDiffBase,
+			new:  strings.Replace(testDiffBase, "[act=ask; uid=+;] [time=10; count=2;]", "[act=ask; uid=+;] [time=10; count=3;]", 1),
+			want: []string{"rule~ 201 @2->2"},
+		},
+		{
+			name: "spacing only", old: testDiffBase,
+			new:  strings.Replace(testDiffBase, "rule : [count] [act=ask; uid=+;] [time=10; count=2;]", "rule:[count]  [act=ask;uid=+]  [time=10;count=2]", 1),
+			want: []string{},
+		},
+		{
+			name: "rule added and removed", old: testDiffBase,
+			new:  strings.Replace(testDiffBase, "[act=post; uid=+;] [time=10; count=2;] [result=2; return=202]", "[act=like; uid=+;] [time=10; count=2;] [result=2; return=203]", 1),
+			want: []string{"rule+ 203 @3", "rule- 202 @3"},
+		},
+		{
+			name: "rules reordered", old: testDiffBase,
+			new: "[dicts]\nglobal_uid_whitelist : conf/global_uid_whitelist.dat\n[rules]\n" +
+				"rule : [direct] [uid @ global_uid_whitelist] [time=1; count=0;] [result=1; return=101]\n" +
+				"rule : [count] [act=post; uid=+;] [time=10; count=2;] [result=2; return=202]\n" +
+				"rule : [count] [act=ask; uid=+;] [time=10; count=2;] [result=2; return=201]\n" + testPolicyResults,
+			want: []string{"rule~ 202 @3->2", "rule~ 201 @2->3"},
+		},
+		{
+			name: "dict entries", old: testDiffBase, oldWhitelist: "10001\n10002\n",
+			new: testDiffBase, newWhitelist: "10001\n10003\n10004\n",
+			want: []string{"dict global_uid_whitelist changed +10003,10004 -10002"},
+		},
+		{
+			name: "result changed", old: testDiffBase,
+			new:  strings.Replace(testDiffBase, `"Str_reason":"Deny"`, `"Str_reason":"Denied"`, 1),
+			want: []string{"result 2 old=true new=true"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var oldPolicy *Policy
+			if c.old != "" {
+				oldPolicy = testDiffPolicy(t, c.old, c.oldWhitelist)
+			}
+			diff := DiffPolicy(oldPolicy, testDiffPolicy(t, c.new, c.newWhitelist))
+			got := testDiffSummary(diff)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("diff:\nwant %q\n got %q", c.want, got)
+			}
+			if diff.Empty() != (len(c.want) == 0) {
+				t.Errorf("Empty() = %v with %d changes", diff.Empty(), len(c.want))
+			}
+		})
+	}
+}
+
+func TestPolicyDiffCount(t *testing.T) {
+	oldPolicy := testDiffPolicy(t, testDiffBase, "10001\n10002\n")
+	newPolicy := testDiffPolicy(t, strings.Replace(testDiffBase, "[time=10; count=2;] [result=2; return=202]", "[time=10; count=5;] [result=2; return=202]", 1), "10001\n10003\n10004\n")
+	got := DiffPolicy(oldPolicy, newPolicy).Count()
+	want := &PolicyDiffCount{
+		RulesChanged: 1,
+		DictsChanged: []DictChangeCount{{Name: "global_uid_whitelist", Status: "changed", Added: 2, Removed: 1}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Count():\nwant %+v\n got %+v", want, got)
+	}
+}
+
+func TestPolicyHistoryDiff(t *testing.T) {
+	history := NewPolicyHistory(2)
+	first := history.Record(testDiffPolicy(t, testDiffBase, "10001\n"), "md5-1", policyOriginFile)
+	if first.diff != nil {
+		t.Errorf("first load: want no diff, got %s", first.diff)
+	}
+	second := history.Record(testDiffPolicy(t, testDiffBase, "10001\n10002\n"), "md5-2", policyOriginFile)
+	if second.previous != first.Version || second.diff == nil {
+		t.Fatalf("second load: want diff against version %d, got previous %d diff %v", first.Version, second.previous, second.diff)
+	}
+	if got := testDiffSummary(second.diff); !reflect.DeepEqual(got, []string{"dict global_uid_whitelist changed +10002 -"}) {
+		t.Errorf("second load diff: %q", got)
+	}
+}
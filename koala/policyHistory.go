@@ -0,0 +1,144 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Policy version history & rollback
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koala
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// 默认保留的策略版本数量
+const defaultPolicyHistorySize = 10
+
+// 策略版本来源
+const (
+	policyOriginFile    = "file"
+	policyOriginRewrite = "rewrite"
+	policyOriginRedis   = "redis"
+)
+
+// PolicyVersion 一个成功加载过的策略版本
+type PolicyVersion struct {
+	Version  int64
+	Md5      string
+	Origin   string // 来源，如 file、rewrite、redis:<版本号>
+	LoadTime time.Time
+	Source   string
+	policy   *Policy
+	previous int64       // 加载前正在使用的版本号，0 表示首次加载或该版本已被淘汰
+	diff     *PolicyDiff // 相对于加载前正在使用的策略的变化；首次加载时为 nil
+}
+
+// PolicyHistory .
+// 策略版本历史，保留最近 N 个成功加载的策略（内存中），用于查看和回滚
+type PolicyHistory struct {
+	lock     sync.Mutex
+	size     int
+	seq      int64
+	current  int64
+	versions []*PolicyVersion
+}
+
+var (
+	// PolicyVersions 全局策略版本历史
+	PolicyVersions *PolicyHistory
+)
+
+// NewPolicyHistory PolicyHistory构造函数，size 为保留的版本数量
+func NewPolicyHistory(size int) *PolicyHistory {
+	if size <= 0 {
+		size = defaultPolicyHistorySize
+	}
+	return &PolicyHistory{
+		size:     size,
+		versions: make([]*PolicyVersion, 0, size),
+	}
+}
+
+// Record 记录一个新加载成功的策略，并将其标记为当前版本；超出保留数量时淘汰最老的版本
+// 同时计算与之前正在使用版本的差异；首次加载时不计算（diff 为 nil），避免启动时比较、记录全部词表条目
+func (h *PolicyHistory) Record(policy *Policy, md5 string, origin string) *PolicyVersion {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var previous *PolicyVersion
+	var previousPolicy *Policy
+	for _, v := range h.versions {
+		if v.Version == h.current {
+			previous, previousPolicy = v, v.policy
+		}
+	}
+
+	h.seq++
+	version := &PolicyVersion{
+		Version:  h.seq,
+		Md5:      md5,
+		Origin:   origin,
+		LoadTime: time.Now(),
+		Source:   policy.source,
+		policy:   policy,
+	}
+	if previous != nil {
+		version.previous = previous.Version
+		version.diff = DiffPolicy(previousPolicy, policy)
+	}
+	h.versions = append(h.versions, version)
+	if len(h.versions) > h.size {
+		h.versions = h.versions[len(h.versions)-h.size:]
+	}
+	h.current = version.Version
+	return version
+}
+
+// List 返回当前保留的全部版本（按加载先后排列），以及正在使用的版本号
+func (h *PolicyHistory) List() ([]*PolicyVersion, int64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	versions := make([]*PolicyVersion, len(h.versions))
+	copy(versions, h.versions)
+	return versions, h.current
+}
+
+// Get 按版本号查找策略版本
+func (h *PolicyHistory) Get(version int64) (*PolicyVersion, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for _, v := range h.versions {
+		if v.Version == version {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// Rollback .
+// 将全局策略配置回滚到指定版本
+// 说明：只替换内存中的策略指针，不改动任何规则、词表文件；
+// 文件再次变化时，PolicyLoader 会照常加载并记录为新版本
+func (h *PolicyHistory) Rollback(version int64) (*PolicyVersion, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for _, v := range h.versions {
+		if v.Version != version {
+			continue
+		}
+		publishPolicy(v.policy)
+		h.current = v.Version
+		return v, nil
+	}
+	return nil, errors.New("policy version not found")
+}
@@ -19,11 +19,21 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/heiyeluren/koala/utility"
 )
 
+// policyLoadLock 串行化策略的加载、改写（PolicyLoader 与 admin 接口之间）
+var policyLoadLock sync.Mutex
+
 // NewPolicyMD5 PolicyMd5 初始化函数
 func NewPolicyMD5() string {
 	m, err := PolicyMD5Str()
@@ -34,44 +44,155 @@ func NewPolicyMD5() string {
 	return m
 }
 
+// 策略加载的触发来源
+const (
+	reloadByPoll   = "poll"
+	reloadByNotify = "inotify"
+	reloadBySignal = "sighup"
+	reloadByPubsub = "pubsub"
+)
+
+// 默认的加载去抖时长（毫秒）
+const defaultPolicyReloadDebounce = 500
+
+var (
+	// 策略加载请求队列，元素为触发来源
+	policyReloadChan = make(chan string, 64)
+	// 规则、词表文件变化监听器；不支持或未开启时为 nil
+	policyFileWatcher *policyWatcher
+)
+
+// TriggerPolicyReload 投递一次策略加载请求（非阻塞；队列满时丢弃，已排队的请求会完成加载）
+func TriggerPolicyReload(by string) {
+	select {
+	case policyReloadChan <- by:
+	default:
+	}
+}
+
 // PolicyLoader .
 // policy实时更新函数
 // 说明：用于实时更新rule配置，解析过程调用PolicyInterpreter()处理
+// 触发：文件变化通知（inotify）或 redis 新版本通知、SIGHUP 信号即时触发；定期轮询作为兜底
+// 去抖：收到请求后等待 policy_reload_debounce 毫秒，期间的请求合并为一次加载
 func PolicyLoader() {
-	var err error
-	var m string
 	logHandle := utility.NewLogger("")
 
-	for {
-		d := Config.GetInt("policy_loader_frequency")
-		if d == 0 {
-			d = 300
+	// 策略来源为 redis 时，订阅新版本通知；否则监听文件变化
+	if policySourceIsRedis() {
+		go policyRedisSubscribe(logHandle)
+	} else if Config.Get("policy_watch") != "no" {
+		watcher, err := newPolicyWatcher()
+		if err != nil {
+			logHandle.Warning("[errmsg=policy watcher disabled, " + err.Error() + "]")
+		} else {
+			policyLoadLock.Lock()
+			policyFileWatcher = watcher
+			policyWatchSync(logHandle)
+			policyLoadLock.Unlock()
+			go watcher.run(logHandle)
 		}
-		time.Sleep(time.Duration(d) * time.Second)
+	}
 
-		m, err = PolicyMD5Str()
-		if err != nil {
-			logHandle.Warning("[errmsg=" + err.Error() + " md5=" + PolicyMd5 + "]")
+	// SIGHUP 信号
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP)
+		for range signals {
+			TriggerPolicyReload(reloadBySignal)
+		}
+	}()
+
+	// 定期轮询
+	go func() {
+		for {
+			d := Config.GetInt("policy_loader_frequency")
+			if d == 0 {
+				d = 300
+			}
+			time.Sleep(time.Duration(d) * time.Second)
+			TriggerPolicyReload(reloadByPoll)
 		}
-		// println(Policy_md5)
-
-		if m != PolicyMd5 {
-			DynamicUpdateFiles = []string{}
-			err = PolicyInterpreter("")
-			if err != nil {
-				logHandle.Warning("[errmsg=" + err.Error() + "]")
-			} else {
-				PolicyMd5 = m
-				logHandle.Trace("[msg=policy reload! new-md5=" + PolicyMd5 + "]")
+	}()
+
+	debounce := Config.GetInt("policy_reload_debounce")
+	if debounce <= 0 {
+		debounce = defaultPolicyReloadDebounce
+	}
+	for {
+		triggers := map[string]bool{<-policyReloadChan: true}
+		timer := time.NewTimer(time.Duration(debounce) * time.Millisecond)
+	merge:
+		for {
+			select {
+			case by := <-policyReloadChan:
+				triggers[by] = true
+			case <-timer.C:
+				break merge
 			}
 		}
+
+		var by []string
+		for k := range triggers {
+			by = append(by, k)
+		}
+		sort.Strings(by)
+		// SIGHUP 强制重新加载；其余来源仅在文件 md5 变化时加载
+		policyReload(strings.Join(by, ","), triggers[reloadBySignal], logHandle)
+	}
+}
+
+/**
+ * 执行一次策略加载，并记录加载结果
+ */
+func policyReload(by string, force bool, logHandle *utility.Logger) {
+	if policySourceIsRedis() {
+		policyRedisReload(by, force, logHandle)
+		return
+	}
+
+	policyLoadLock.Lock()
+	defer policyLoadLock.Unlock()
+
+	m, err := PolicyMD5Str()
+	if err != nil {
+		logHandle.Warning("[errmsg=" + err.Error() + " md5=" + PolicyMd5 + " by=" + by + "]")
+	}
+	// println(Policy_md5)
+
+	if m == PolicyMd5 && !force {
+		logHandle.Trace("[msg=policy unchanged, skip reload. md5=" + PolicyMd5 + " by=" + by + "]")
+		return
+	}
+
+	if err = PolicyInterpreter(""); err != nil {
+		logHandle.Warning("[errmsg=policy reload failed! " + err.Error() + " md5=" + PolicyMd5 + " by=" + by + "]")
+		return
+	}
+	// 词表文件可能已变化，按新策略重新计算 md5
+	PolicyMd5 = NewPolicyMD5()
+	version := PolicyVersions.Record(CurrentPolicy(), PolicyMd5, policyOriginFile)
+	policyWatchSync(logHandle)
+	logHandle.Trace("[msg=policy reload! new-md5=" + PolicyMd5 + " version=" + strconv.FormatInt(version.Version, 10) + " by=" + by + "]")
+	policyDiffTrace(version, version.diff, by, logHandle)
+}
+
+/**
+ * 按当前策略引用的文件更新文件监听范围；调用方需持有 policyLoadLock
+ */
+func policyWatchSync(logHandle *utility.Logger) {
+	if policyFileWatcher == nil {
+		return
+	}
+	if err := policyFileWatcher.watch(CurrentPolicy().files); err != nil {
+		logHandle.Warning("[errmsg=policy watcher sync failed, " + err.Error() + "]")
 	}
 }
 
-// PolicyMD5Str 计算 DynamicUpdateFiles 所包含文件的 md5 值
+// PolicyMD5Str 计算当前策略引用的文件（rule 文件 + dicts 文件）的 md5 值
 func PolicyMD5Str() (string, error) {
 	var contentStream bytes.Buffer
-	for _, file := range DynamicUpdateFiles {
+	for _, file := range CurrentPolicy().files {
 		rawStream, err := ioutil.ReadFile(file)
 		if err != nil {
 			return "", errors.New("cannot load policy file")
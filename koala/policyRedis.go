@@ -0,0 +1,275 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Policy source on redis (cluster-wide distribution)
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koala
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/heiyeluren/koala/utility"
+)
+
+/*
+redis 策略来源（policy_source = redis）
+
+以 policy_redis_prefix（默认 koala:policy）为前缀：
+  <prefix>:current               string  当前发布的版本号
+  <prefix>:version:<版本号>       hash    rules 字段为完整的规则配置原文（[dicts] [rules] [result]）
+                                         format 字段为 json 时，rules 为 json 格式的规则配置
+                                         dict:<词表名> 字段为词表内容，一行一条；[dicts] 中的文件名此时不使用
+  <prefix>:notify                channel 发布新版本时 PUBLISH 版本号，各实例收到后加载 current 指向的版本
+  <prefix>:instances             hash    各实例上报正在使用的版本，field 为实例标识
+
+发布新版本示例：
+  HSET koala:policy:version:v2 rules "<规则原文>" dict:global_uid_whitelist "<词表内容>"
+  SET koala:policy:current v2
+  PUBLISH koala:policy:notify v2
+*/
+
+// 策略来源
+const (
+	policySourceFile  = "file"
+	policySourceRedis = "redis"
+)
+
+const (
+	defaultPolicyRedisPrefix = "koala:policy"
+	// 订阅连接的心跳间隔
+	policySubscribePing = 30 * time.Second
+)
+
+var (
+	// PolicyRedisVersion 正在使用的 redis 策略版本号（policy_source=redis 时有效）
+	PolicyRedisVersion string
+)
+
+// policyInstanceReport 实例上报的版本信息
+type policyInstanceReport struct {
+	Version  string `json:"version"`
+	Md5      string `json:"md5"`
+	LoadTime string `json:"load_time"`
+}
+
+/**
+ * 是否使用 redis 作为策略来源
+ */
+func policySourceIsRedis() bool {
+	return Config.Get("policy_source") == policySourceRedis
+}
+
+/**
+ * 拼装 redis 策略相关的 key
+ */
+func policyRedisKey(parts ...string) string {
+	prefix := Config.Get("policy_redis_prefix")
+	if prefix == "" {
+		prefix = defaultPolicyRedisPrefix
+	}
+	return prefix + ":" + strings.Join(parts, ":")
+}
+
+/**
+ * 实例标识；默认为 主机名 + 监听地址
+ */
+func policyInstanceID() string {
+	if id := Config.Get("instance_id"); id != "" {
+		return id
+	}
+	hostname, _ := os.Hostname()
+	return hostname + Config.Get("listen")
+}
+
+// RedisPolicyCurrentVersion 读取 redis 中当前发布的策略版本号
+func RedisPolicyCurrentVersion() (string, error) {
+	redisConn := RedisPool.Get()
+	defer redisConn.Close()
+
+	version, err := redis.String(redisConn.Do("GET", policyRedisKey("current")))
+	if err == redis.ErrNil {
+		return "", errors.New("no policy version published")
+	}
+	return version, err
+}
+
+// RedisPolicyParse .
+// 从 redis 读取指定版本的规则原文、词表，解析并校验；返回新的 Policy 及其 md5，不覆盖全局策略配置
+func RedisPolicyParse(version string) (*Policy, string, error) {
+	redisConn := RedisPool.Get()
+	fields, err := redis.StringMap(redisConn.Do("HGETALL", policyRedisKey("version", version)))
+	redisConn.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	rules, OK := fields["rules"]
+	if !OK {
+		return nil, "", errors.New("cannot load rule of policy version " + version)
+	}
+
+	isJSON := fields["format"] == "json"
+	policy, err := policyParseStream([]byte(rules), isJSON, func(dictName, fileName string) ([]byte, error) {
+		content, OK := fields["dict:"+dictName]
+		if !OK {
+			return nil, errors.New("dict not found")
+		}
+		return []byte(content), nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	// md5 覆盖规则原文和全部词表内容
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	versionMd5 := md5.New()
+	for _, name := range names {
+		io.WriteString(versionMd5, name+"\n"+fields[name]+"\n")
+	}
+	return policy, fmt.Sprintf("%x", versionMd5.Sum(nil)), nil
+}
+
+// RedisPolicyInterpreter .
+// 加载 redis 中当前发布的策略版本，覆盖全局策略配置，并上报本实例使用的版本
+// 说明：调用方需持有 policyLoadLock（启动时除外）
+func RedisPolicyInterpreter() (*PolicyVersion, error) {
+	version, err := RedisPolicyCurrentVersion()
+	if err != nil {
+		return nil, err
+	}
+	policy, policyMd5, err := RedisPolicyParse(version)
+	if err != nil {
+		return nil, errors.New(err.Error() + " ;VERSION-" + version)
+	}
+
+	publishPolicy(policy)
+	PolicyMd5 = policyMd5
+	PolicyRedisVersion = version
+	loaded := PolicyVersions.Record(policy, policyMd5, policyOriginRedis+":"+version)
+
+	if err = policyRedisReport(loaded); err != nil {
+		return loaded, errors.New("policy version report failed, " + err.Error())
+	}
+	return loaded, nil
+}
+
+/**
+ * 上报本实例正在使用的策略版本
+ */
+func policyRedisReport(loaded *PolicyVersion) error {
+	report, err := json.Marshal(policyInstanceReport{
+		Version:  PolicyRedisVersion,
+		Md5:      loaded.Md5,
+		LoadTime: loaded.LoadTime.Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+
+	redisConn := RedisPool.Get()
+	defer redisConn.Close()
+	_, err = redisConn.Do("HSET", policyRedisKey("instances"), policyInstanceID(), string(report))
+	return err
+}
+
+/**
+ * redis 来源的一次策略加载；当前发布版本未变化时跳过（force 时除外）
+ */
+func policyRedisReload(by string, force bool, logHandle *utility.Logger) {
+	policyLoadLock.Lock()
+	defer policyLoadLock.Unlock()
+
+	version, err := RedisPolicyCurrentVersion()
+	if err != nil {
+		logHandle.Warning("[errmsg=policy reload failed! " + err.Error() + " version=" + PolicyRedisVersion + " by=" + by + "]")
+		return
+	}
+	if version == PolicyRedisVersion && !force {
+		logHandle.Trace("[msg=policy unchanged, skip reload. version=" + PolicyRedisVersion + " by=" + by + "]")
+		return
+	}
+
+	loaded, err := RedisPolicyInterpreter()
+	if loaded == nil {
+		logHandle.Warning("[errmsg=policy reload failed! " + err.Error() + " version=" + PolicyRedisVersion + " by=" + by + "]")
+		return
+	}
+	if err != nil {
+		logHandle.Warning("[errmsg=" + err.Error() + "]")
+	}
+	logHandle.Trace("[msg=policy reload! version=" + PolicyRedisVersion + " md5=" + PolicyMd5 + " by=" + by + "]")
+	policyDiffTrace(loaded, loaded.diff, by, logHandle)
+}
+
+/**
+ * 订阅新版本通知；连接断开后自动重连，重连后补做一次加载检查
+ */
+func policyRedisSubscribe(logHandle *utility.Logger) {
+	for {
+		policyRedisReceive(logHandle)
+		time.Sleep(time.Second)
+		TriggerPolicyReload(reloadByPubsub)
+	}
+}
+
+/**
+ * 订阅并接收通知，直到连接出错
+ */
+func policyRedisReceive(logHandle *utility.Logger) {
+	psc := redis.PubSubConn{Conn: RedisPool.Get()}
+	defer psc.Close()
+
+	if err := psc.Subscribe(policyRedisKey("notify")); err != nil {
+		logHandle.Warning("[errmsg=policy subscribe failed, " + err.Error() + "]")
+		return
+	}
+
+	// 心跳，及时发现断开的连接
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(policySubscribePing)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := psc.Ping(""); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		switch v := psc.ReceiveWithTimeout(2 * policySubscribePing).(type) {
+		case redis.Message:
+			logHandle.Trace("[msg=policy version announced. version=" + string(v.Data) + "]")
+			TriggerPolicyReload(reloadByPubsub)
+		case error:
+			logHandle.Warning("[errmsg=policy subscribe interrupted, " + v.Error() + "]")
+			return
+		}
+	}
+}
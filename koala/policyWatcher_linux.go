@@ -0,0 +1,130 @@
+//go:build linux
+// +build linux
+
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Policy file watcher (inotify)
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koala
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/heiyeluren/koala/utility"
+)
+
+// 监听的事件：写入完成、移入（编辑器/原子替换常用 rename）、新建、删除
+const policyWatchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_DELETE
+
+// policyWatcher .
+// 基于 inotify 的规则、词表文件变化监听器
+// 说明：监听文件所在目录而不是文件本身，这样文件被 rename 替换后仍然有效
+type policyWatcher struct {
+	fd    int
+	lock  sync.Mutex
+	dirs  map[string]int          // 目录 -> watch descriptor
+	names map[int]map[string]bool // watch descriptor -> 需要关注的文件名
+}
+
+func newPolicyWatcher() (*policyWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &policyWatcher{
+		fd:    fd,
+		dirs:  make(map[string]int),
+		names: make(map[int]map[string]bool),
+	}, nil
+}
+
+/**
+ * 设置需要监听的文件列表；不再需要的目录会被移除监听
+ */
+func (w *policyWatcher) watch(files []string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	names := make(map[int]map[string]bool)
+	for _, file := range files {
+		absFile, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		dir := filepath.Dir(absFile)
+		wd, OK := w.dirs[dir]
+		if !OK {
+			if wd, err = syscall.InotifyAddWatch(w.fd, dir, policyWatchMask); err != nil {
+				return err
+			}
+			w.dirs[dir] = wd
+		}
+		if _, OK = names[wd]; !OK {
+			names[wd] = make(map[string]bool)
+		}
+		names[wd][filepath.Base(absFile)] = true
+	}
+	w.names = names
+
+	for dir, wd := range w.dirs {
+		if _, OK := names[wd]; !OK {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, dir)
+		}
+	}
+	return nil
+}
+
+/**
+ * 判断事件是否与关注的文件相关
+ */
+func (w *policyWatcher) matches(wd int, name string) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.names[wd][name]
+}
+
+/**
+ * 读取 inotify 事件，关注的文件有变化时，投递策略加载请求
+ */
+func (w *policyWatcher) run(logHandle *utility.Logger) {
+	buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(w.fd, buffer)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			logHandle.Warning("[errmsg=policy watcher stopped]")
+			return
+		}
+
+		offset := 0
+		for offset+syscall.SizeofInotifyEvent <= n {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameEnd := nameStart + int(event.Len)
+			if nameEnd > n {
+				break
+			}
+			name := strings.TrimRight(string(buffer[nameStart:nameEnd]), "\x00")
+			if w.matches(int(event.Wd), name) {
+				TriggerPolicyReload(reloadByNotify)
+			}
+			offset = nameEnd
+		}
+	}
+}
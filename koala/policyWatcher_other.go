@@ -0,0 +1,36 @@
+//go:build !linux
+// +build !linux
+
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Policy file watcher (unsupported platforms)
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koala
+
+import (
+	"errors"
+
+	"github.com/heiyeluren/koala/utility"
+)
+
+// policyWatcher 非 linux 平台不支持文件变化通知，只依靠定期轮询和 SIGHUP
+type policyWatcher struct{}
+
+func newPolicyWatcher() (*policyWatcher, error) {
+	return nil, errors.New("file notification not supported on this platform")
+}
+
+func (w *policyWatcher) watch(files []string) error {
+	return nil
+}
+
+func (w *policyWatcher) run(logHandle *utility.Logger) {
+}
@@ -0,0 +1,155 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Policy parse tests
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koala
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// 测试用的返回结果配置
+const testPolicyResults = `[result]
+1 : { "Ret_type":1, "Ret_code":0, "Err_no":0, "Err_msg":"", "Str_reason":"Allow", "Need_vcode":0, "Vcode_len":0, "Vcode_type":0, "Other":"", "Version":0 }
+2 : { "Ret_type":2, "Ret_code":0, "Err_no":10, "Err_msg":"limit {limit}, retry in {reset_in}s", "Str_reason":"Deny", "Need_vcode":0, "Vcode_len":0, "Vcode_type":0, "Other":"", "Version":0 }
+`
+
+/**
+ * 测试用的词表读取：global_uid_whitelist 有内容，其余词表不存在
+ */
+func testDictReader(dictName, fileName string) ([]byte, error) {
+	if dictName == "global_uid_whitelist" {
+		return []byte("10001\n10002\n"), nil
+	}
+	return nil, errors.New("no such dict")
+}
+
+func TestPolicyParseStream(t *testing.T) {
+	cases := []struct {
+		name    string
+		stream  string
+		isJSON  bool
+		err     string   // 期望的错误信息片段；为空时期望解析成功
+		rules   []string // 期望的 rule（dump 格式），按顺序
+		results int      // 期望的返回结果配置数
+	}{
+		{
+			name: "bracket",
+			stream: "[dicts]\nglobal_uid_whitelist : conf/global_uid_whitelist.dat\n[rules]\n" +
+				"rule : [direct] [uid @ global_uid_whitelist] [time=1; count=0;] [result=1; return=101]\n" +
+				"rule : [count] [act=ask; uid=+;] [time=10; count=2;] [result=2; return=201]\n" + testPolicyResults,
+			rules: []string{
+				"[direct] [uid:@global_uid_whitelist;] [base=0; time=1; count=0; erase1=0; erase2=0;] [result=1; return=101;]",
+				"[count] [act:ask,;uid:+^0^0&;] [base=0; time=10; count=2; erase1=0; erase2=0;] [result=2; return=201;]",
+			},
+			results: 2,
+		},
+		{
+			name:    "stray space between sections",
+			stream:  "[rules]\nrule :  [count]   [act=ask;uid=+]  [time=10;count=2]\t[result=2; return=201;]  \r\n" + testPolicyResults,
+			rules:   []string{"[count] [act:ask,;uid:+^0^0&;] [base=0; time=10; count=2; erase1=0; erase2=0;] [result=2; return=201;]"},
+			results: 2,
+		},
+		{
+			name:   "section error",
+			stream: "[rules]\nrule : [count] act=ask; [time=10; count=2;] [result=2; return=201]\n" + testPolicyResults,
+			err:    "section error",
+		},
+		{
+			name:   "unknown dict",
+			stream: "[dicts]\nglobal_uid_blacklist : conf/global_uid_blacklist.dat\n[rules]\n" + testPolicyResults,
+			err:    "cannot load dict file",
+		},
+		{
+			name: "unknown placeholder",
+			stream: "[rules]\nrule : [count] [act=ask; uid=+;] [time=10; count=2;] [result=2; return=201]\n[result]\n" +
+				`2 : { "Ret_type":2, "Err_msg":"limit {limt}", "Str_reason":"Deny" }` + "\n",
+			err: "unknown placeholder {limt}",
+		},
+		{
+			name:   "result type not found",
+			stream: "[rules]\nrule : [count] [act=ask; uid=+;] [time=10; count=2;] [result=3; return=201]\n" + testPolicyResults,
+			err:    "result type no found",
+		},
+		{
+			name: "same return code",
+			stream: "[rules]\nrule : [count] [act=ask; uid=+;] [time=10; count=2;] [result=2; return=201]\n" +
+				"rule : [count] [act=post; uid=+;] [time=10; count=2;] [result=2; return=201]\n" + testPolicyResults,
+			err: "same return code",
+		},
+		{
+			name: "json",
+			stream: `{
+  "dicts": [{"name": "global_uid_whitelist", "file": "conf/global_uid_whitelist.dat"}],
+  "rules": [
+    {"method": "direct", "keys": ["uid @ global_uid_whitelist"], "time": 1, "count": 0, "result": 1, "return": 101},
+    {"method": "leak", "keys": ["act=ask", "uid=+"], "time": 5, "count": 2, "result": 2, "return": 301}
+  ],
+  "results": [
+    {"id": 1, "value": {"Ret_type": 1, "Str_reason": "Allow"}},
+    {"id": 2, "value": {"Ret_type": 2, "Str_reason": "Deny {remaining}"}}
+  ]
+}`,
+			isJSON: true,
+			rules: []string{
+				"[direct] [uid:@global_uid_whitelist;] [base=0; time=1; count=0; erase1=0; erase2=0;] [result=1; return=101;]",
+				"[leak] [act:ask,;uid:+^0^0&;] [base=0; time=5; count=2; erase1=0; erase2=0;] [result=2; return=301;]",
+			},
+			results: 2,
+		},
+		{
+			name:   "json unknown placeholder",
+			stream: `{"rules": [], "results": [{"id": 2, "value": {"Ret_type": 2, "Str_reason": "{nope}"}}]}`,
+			isJSON: true,
+			err:    "unknown placeholder {nope}",
+		},
+		{
+			name:   "json bad method",
+			stream: `{"rules": [{"method": "burst", "keys": ["act=ask"], "time": 1, "count": 1, "result": 2, "return": 1}], "results": []}`,
+			isJSON: true,
+			err:    "AT-RULE-0",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			policy, err := policyParseStream([]byte(c.stream), c.isJSON, testDictReader)
+			if c.err != "" {
+				if err == nil {
+					t.Fatalf("want error containing %q, got nil", c.err)
+				}
+				if !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("want error containing %q, got %q", c.err, err.Error())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(policy.ruleTable) != len(c.rules) {
+				t.Fatalf("want %d rules, got %d", len(c.rules), len(policy.ruleTable))
+			}
+			for i, want := range c.rules {
+				if got := policy.ruleTable[i].dump(); got != want {
+					t.Errorf("rule %d:\nwant %s\n got %s", i, want, got)
+				}
+			}
+			if len(policy.retValueTable) != c.results {
+				t.Errorf("want %d results, got %d", c.results, len(policy.retValueTable))
+			}
+			if policy.source != c.stream {
+				t.Errorf("source not kept")
+			}
+		})
+	}
+}
@@ -0,0 +1,705 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Quota reservation (reserve / commit / cancel)
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koala
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/heiyeluren/koala/utility"
+)
+
+// 预留流程：浏览时带 _reserve=yes，未超出限制时原子地占用各匹配 rule 的额度，并返回预留 token（Reservation）
+// 调用方完成动作后调用 /rule/commit 保留占用，动作失败时调用 /rule/cancel 退还；
+// reserve_timeout 秒内未 commit/cancel 的预留，由 ReserveAgent 自动退还
+// 预留记录保存在 redis 中，任一 koala 实例都可以 commit/cancel；以从待处理集合中 ZREM 成功作为处理权，避免重复退还
+// count、base 的退还只作用于预留时的窗口：窗口以计数 key 的过期时间区分，key 过期重建后不再退还；
+// /rule/reset 删除缓存 key 时，同时从预留记录中移除这些 key 的占用
+
+const (
+	defaultReserveRedisPrefix = "koala:reserve"
+	defaultReserveTimeout     = 60
+	reservePendingKey         = "pending"
+	reserveKeyIndexPrefix     = "key:"
+	reserveSweepBatch         = 100
+	reserveWindowSlack        = 500 // 比较窗口过期时间时允许的误差（毫秒），需小于最短的窗口
+	reserveDropRetry          = 3
+)
+
+// errReservationNotFound 预留不存在：token 错误，或已经 commit、cancel、超时退还
+var errReservationNotFound = errors.New("reservation not found or expired")
+
+// reservedRule 一条 rule 的额度占用，退还时按此回退
+type reservedRule struct {
+	Return   int32  `json:"return"`
+	Method   string `json:"method"`
+	CacheKey string `json:"cache_key"`
+	Base     bool   `json:"base,omitempty"`  // base 规则：同时计入了 _B 后缀 key
+	Value    int64  `json:"value,omitempty"` // leak 规则：写入桶内的时间戳
+	// count、base 规则：占用时计数 key（及 _B 后缀 key）的过期时间（毫秒时间戳），标识所在的窗口；为 0 时不比较
+	Window     int64 `json:"window,omitempty"`
+	BaseWindow int64 `json:"base_window,omitempty"`
+}
+
+// reservation 预留记录
+type reservation struct {
+	Token    string         `json:"token"`
+	Created  int64          `json:"created"`
+	Deadline int64          `json:"deadline"`
+	Rules    []reservedRule `json:"rules"`
+}
+
+// reserveRefund 单条 rule 的退还结果
+type reserveRefund struct {
+	Return   int32  `json:"return"`
+	Method   string `json:"method"`
+	CacheKey string `json:"cache_key"`
+	OK       bool   `json:"ok"`
+	Skipped  bool   `json:"skipped,omitempty"` // 窗口已轮换或 key 已重置，无需退还
+	Error    string `json:"error,omitempty"`
+}
+
+// reserveCancelResult /rule/cancel 的返回数据
+type reserveCancelResult struct {
+	Token string          `json:"token"`
+	Rules []reserveRefund `json:"rules"`
+}
+
+/**
+ * count模式--预留：未超出限制时计数加 1，与 countBrowse + countUpdate 一致
+ * 返回 {结果, key 的剩余毫秒数}；结果 0 表示超出限制
+ */
+var countReserveScript = redis.NewScript(1, `
+local v = redis.call('GET', KEYS[1])
+if v and tonumber(v) >= tonumber(ARGV[1]) then return {0, 0} end
+if v then redis.call('INCR', KEYS[1]) else redis.call('SET', KEYS[1], 1, 'EX', ARGV[2]) end
+return {1, redis.call('PTTL', KEYS[1])}
+`)
+
+/**
+ * base模式--预留：与 baseBrowse + baseUpdate 一致
+ * 返回 {结果, key 的剩余毫秒数, _B 后缀 key 的剩余毫秒数}；结果 0 表示超出限制，2 表示同时计入了 _B 后缀 key
+ */
+var baseReserveScript = redis.NewScript(2, `
+local base, count = tonumber(ARGV[1]), tonumber(ARGV[2])
+local v = redis.call('GET', KEYS[1])
+if v and base > 0 and count > 0 and tonumber(v) >= base then
+  local b = redis.call('GET', KEYS[2])
+  if b and tonumber(b) >= count then return {0, 0, 0} end
+end
+if not v then
+  redis.call('SET', KEYS[1], 1, 'EX', ARGV[3])
+  return {1, redis.call('PTTL', KEYS[1]), 0}
+end
+local n = redis.call('INCR', KEYS[1])
+if base == 0 or n < base then return {1, redis.call('PTTL', KEYS[1]), 0} end
+if redis.call('EXISTS', KEYS[2]) == 1 then redis.call('INCR', KEYS[2]) else redis.call('SET', KEYS[2], 1, 'EX', ARGV[4]) end
+return {2, redis.call('PTTL', KEYS[1]), redis.call('PTTL', KEYS[2])}
+`)
+
+/**
+ * count、base 模式--退还：key 的过期时间（ARGV[1] 为当前毫秒时间戳）与预留时记录的 ARGV[2] 相差不超过 ARGV[3] 毫秒时，
+ * 计数减 1（不低于 0）；返回 1 表示已退还
+ * key 不存在或过期时间不同（窗口已轮换、key 已重置后重建）时不退还，避免扣减新窗口的计数
+ */
+var countRefundScript = redis.NewScript(1, `
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 then return 0 end
+if math.abs(tonumber(ARGV[1]) + ttl - tonumber(ARGV[2])) > tonumber(ARGV[3]) then return 0 end
+local v = tonumber(redis.call('GET', KEYS[1]))
+if not v or v <= 0 then return 0 end
+redis.call('DECR', KEYS[1])
+return 1
+`)
+
+/**
+ * 取得预留的处理权：从待处理集合（score 为超时时间）中移除 token；ARGV[2] 大于 0 时，超时时间不晚于它的不移除
+ * 返回 1 表示取得
+ */
+var reserveTakeScript = redis.NewScript(1, `
+local deadline = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not deadline then return 0 end
+if tonumber(ARGV[2]) > 0 and tonumber(deadline) <= tonumber(ARGV[2]) then return 0 end
+return redis.call('ZREM', KEYS[1], ARGV[1])
+`)
+
+/**
+ * leak模式--预留：与 leakBrowse + leakUpdate 一致；返回 0 表示超出限制
+ */
+var leakReserveScript = redis.NewScript(1, `
+local count, window, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local len = redis.call('LLEN', KEYS[1])
+if len > count then
+  local edge = tonumber(redis.call('LINDEX', KEYS[1], count))
+  if edge and now - edge <= window then return 0 end
+end
+redis.call('LPUSH', KEYS[1], now)
+redis.call('EXPIRE', KEYS[1], window)
+return 1
+`)
+
+/**
+ * 预留一条可更新的 rule：判定与占用额度在同一脚本中完成；超出限制时不占用，返回 isOut 为 true
+ */
+func (k *Rule) reserve(cacheKey string) (reservedRule, bool, error) {
+	redisConn := k.redisConn()
+	defer redisConn.Close()
+
+	taken := reservedRule{Return: k.returnCode, Method: k.method, CacheKey: cacheKey}
+	var ret int
+	var err error
+	switch k.method {
+	case "count":
+		var values []int64
+		if values, err = redis.Int64s(countReserveScript.Do(redisConn, cacheKey, k.count, k.countExpireTime())); err == nil {
+			ret = int(values[0])
+			taken.Window = windowOf(values[1])
+		}
+	case "base":
+		var values []int64
+		if values, err = redis.Int64s(baseReserveScript.Do(redisConn, cacheKey, cacheKey+BaseKeySuffix, k.base, k.count, baseExpireTime(), k.time)); err == nil {
+			ret = int(values[0])
+			taken.Window = windowOf(values[1])
+			taken.Base = ret == 2
+			if taken.Base {
+				taken.BaseWindow = windowOf(values[2])
+			}
+		}
+	case "leak":
+		taken.Value = time.Now().Unix()
+		ret, err = redis.Int(leakReserveScript.Do(redisConn, cacheKey, k.count, k.time, taken.Value))
+	default:
+		return taken, false, errors.New("rule method " + k.method + " can not reserve")
+	}
+	if err != nil {
+		return taken, false, err
+	}
+	return taken, ret == 0, nil
+}
+
+/**
+ * 当前毫秒时间戳
+ */
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+/**
+ * 由 key 的剩余毫秒数得出过期时间（毫秒时间戳）；key 没有过期时间时返回 0，退还时不比较窗口
+ */
+func windowOf(pttl int64) int64 {
+	if pttl <= 0 {
+		return 0
+	}
+	return nowMillis() + pttl
+}
+
+/**
+ * 退还一个计数 key 的占用；window 为预留时记录的过期时间，为 0 时（旧版本的预留记录）不比较窗口
+ */
+func refundCounter(redisConn redis.Conn, cacheKey string, window int64) (bool, error) {
+	if window == 0 {
+		values, err := redis.Int64s(countFeedbackScript.Do(redisConn, cacheKey, 1))
+		if err != nil {
+			return false, err
+		}
+		return values[0] != values[1], nil
+	}
+	return redis.Bool(countRefundScript.Do(redisConn, cacheKey, nowMillis(), window, reserveWindowSlack))
+}
+
+/**
+ * 退还一条 rule 的占用：count、base 计数减 1（不低于 0，且只在预留时的窗口内），leak 移除预留时写入的元素
+ * 返回是否实际退还
+ */
+func (r reservedRule) refund(redisConn redis.Conn) (bool, error) {
+	switch r.Method {
+	case "count", "base":
+		refunded, err := refundCounter(redisConn, r.CacheKey, r.Window)
+		if err != nil {
+			return false, err
+		}
+		if r.Base {
+			baseRefunded, err := refundCounter(redisConn, r.CacheKey+BaseKeySuffix, r.BaseWindow)
+			if err != nil {
+				return refunded, err
+			}
+			refunded = refunded || baseRefunded
+		}
+		return refunded, nil
+	case "leak":
+		removed, err := redis.Int(redisConn.Do("LREM", r.CacheKey, 1, r.Value))
+		if err != nil {
+			return false, err
+		}
+		return removed > 0, nil
+	default:
+	}
+	return false, nil
+}
+
+/**
+ * 退还多条 rule 的占用；返回每条 rule 的退还结果
+ */
+func (p *Policy) refundReserved(rules []reservedRule, logHandle *utility.Logger) []reserveRefund {
+	redisConn := p.redisConn()
+	defer redisConn.Close()
+
+	results := make([]reserveRefund, 0, len(rules))
+	for _, r := range rules {
+		one := reserveRefund{Return: r.Return, Method: r.Method, CacheKey: r.CacheKey, OK: true}
+		refunded, err := r.refund(redisConn)
+		if err != nil {
+			logHandle.Fatal("[errmsg=reservation refund failed, " + err.Error() + " cachekey=" + r.CacheKey + "]")
+			one.OK = false
+			one.Error = err.Error()
+		} else if !refunded {
+			logHandle.Notice("[msg=reservation refund skipped, window rolled over or key reset cachekey=" + r.CacheKey + "]")
+			one.Skipped = true
+		}
+		results = append(results, one)
+	}
+	return results
+}
+
+/**
+ * 预留查询：按顺序匹配每条 rule，与 browse 的判定一致
+ * 可更新的 rule 在判定的同时占用额度；首个超出限制的 rule 决定结果，此时退还本次已占用的额度，返回的预留为空
+ * 缓存出错的 rule 记录日志，按未超出限制处理，且不占用额度
+ */
+func (p *Policy) reserve(ctx context.Context, params map[string]string, withQuota bool, hook decisionHook, logHandle *utility.Logger) (RetValue, []reservedRule, error) {
+	var singleRule Rule
+	var firstErr error
+	var retValue = p.retValueTable[0]
+	var taken = []reservedRule{}
+	var quota *RetQuota
+	for _, singleRule = range p.ruleTable {
+		if err := ctx.Err(); err != nil {
+			p.refundReserved(taken, logHandle)
+			return retValue, nil, err
+		}
+		if !singleRule.satisfied(params) {
+			continue
+		}
+
+		ruleCacheKey := singleRule.getCacheKey(params)
+		var isOut bool
+		var err error
+		if singleRule.updatable() {
+			var one reservedRule
+			one, isOut, err = singleRule.reserve(ruleCacheKey)
+			if err == nil && !isOut {
+				taken = append(taken, one)
+			}
+		} else {
+			isOut, err = singleRule.browse(ruleCacheKey)
+		}
+		if err != nil {
+			logHandle.Fatal("[errmsg=" + err.Error() + "]")
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		if hook != nil {
+			hook(&singleRule, ruleCacheKey, params, isOut)
+		}
+
+		var state *RuleState
+		if withQuota || (isOut && p.retValueTable[int(singleRule.result)].hasTemplate()) {
+			state = ruleState(&singleRule, ruleCacheKey, logHandle)
+		}
+		if withQuota {
+			if isOut {
+				quota = singleRule.retQuota(state, true)
+			} else {
+				quota = tighterQuota(quota, singleRule.retQuota(state, false))
+			}
+		}
+
+		// 超出限制：退还之前 rule 已占用的额度
+		if isOut {
+			p.refundReserved(taken, logHandle)
+			retValue = p.retValueTable[int(singleRule.result)]
+			retValue.RetCode = singleRule.returnCode
+			retValue.render(&singleRule, state, params)
+			retValue.RetQuota = quota
+			return retValue, nil, firstErr
+		}
+		retValue = p.retValueTable[1]
+	}
+	retValue.render(nil, nil, params)
+	retValue.RetQuota = quota
+	return retValue, taken, firstErr
+}
+
+/**
+ * 预留查询并保存预留记录；保存失败时退还已占用的额度，结果中不带预留 token
+ */
+func ruleReserveLogic(params map[string]string, logHandle *utility.Logger) RetValue {
+	// 本地策略指针，可避免匹配过程中Global策略被替换 导致不一致；查询出错已记录日志，按未超出限制返回
+	localPolicy := CurrentPolicy()
+	retValue, taken, _ := localPolicy.reserve(context.Background(), params, quotaRequested(params), recordDecision, logHandle)
+	if taken == nil {
+		return retValue
+	}
+	token, err := localPolicy.saveReservation(taken)
+	if err != nil {
+		logHandle.Fatal("[errmsg=reservation save failed, " + err.Error() + "]")
+		localPolicy.refundReserved(taken, logHandle)
+		return retValue
+	}
+	retValue.Reservation = token
+	return retValue
+}
+
+/**
+ * 拼装预留相关的 key
+ */
+func reserveRedisKey(name string) string {
+	prefix := Config.Get("reserve_redis_prefix")
+	if prefix == "" {
+		prefix = defaultReserveRedisPrefix
+	}
+	return prefix + ":" + name
+}
+
+/**
+ * 预留超时时长（秒）
+ */
+func reserveTimeout() int64 {
+	if timeout := Config.GetInt("reserve_timeout"); timeout > 0 {
+		return int64(timeout)
+	}
+	return defaultReserveTimeout
+}
+
+/**
+ * 生成预留 token：16 字节随机数的十六进制
+ */
+func newReserveToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+/**
+ * 检查 token 格式，避免拼出任意 key
+ */
+func validReserveToken(token string) bool {
+	if len(token) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(token)
+	return err == nil
+}
+
+/**
+ * 按缓存 key 索引预留 token 的集合，/rule/reset 据此找到需要移除占用的预留
+ */
+func reserveKeyIndex(cacheKey string) string {
+	return reserveRedisKey(reserveKeyIndexPrefix + cacheKey)
+}
+
+/**
+ * 保存预留记录，加入待处理集合（score 为超时时间）和各缓存 key 的索引；返回预留 token
+ * 记录本身的过期时间长于超时时间，留给 ReserveAgent 退还
+ */
+func (p *Policy) saveReservation(rules []reservedRule) (string, error) {
+	token, err := newReserveToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().Unix()
+	timeout := reserveTimeout()
+	record, err := json.Marshal(reservation{Token: token, Created: now, Deadline: now + timeout, Rules: rules})
+	if err != nil {
+		return "", err
+	}
+
+	redisConn := p.redisConn()
+	defer redisConn.Close()
+	redisConn.Send("MULTI")
+	redisConn.Send("SET", reserveRedisKey(token), record, "EX", timeout*2+60)
+	redisConn.Send("ZADD", reserveRedisKey(reservePendingKey), now+timeout, token)
+	for _, r := range rules {
+		redisConn.Send("SADD", reserveKeyIndex(r.CacheKey), token)
+		redisConn.Send("EXPIRE", reserveKeyIndex(r.CacheKey), timeout*2+60)
+	}
+	if _, err := redisConn.Do("EXEC"); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+/**
+ * 取得预留的处理权并读出记录：从待处理集合中移除成功的一方负责 commit、cancel 或超时退还
+ * live 为 true 时（commit、cancel）只取未超时的预留，超时的留给 ReserveAgent 退还，避免超时后 commit 保留已退还或将退还的额度
+ * 记录已不存在时（例如 redis 数据被清理），返回没有 rule 的预留
+ */
+func (p *Policy) takeReservation(token string, live bool) (*reservation, error) {
+	redisConn := p.redisConn()
+	defer redisConn.Close()
+
+	// 待处理集合的 score 即预留的 Deadline
+	var deadline int64
+	if live {
+		deadline = time.Now().Unix()
+	}
+	removed, err := redis.Int(reserveTakeScript.Do(redisConn, reserveRedisKey(reservePendingKey), token, deadline))
+	if err != nil {
+		return nil, err
+	}
+	if removed == 0 {
+		return nil, errReservationNotFound
+	}
+
+	record, err := redis.Bytes(redisConn.Do("GET", reserveRedisKey(token)))
+	if err == redis.ErrNil {
+		return &reservation{Token: token}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	one := new(reservation)
+	if err := json.Unmarshal(record, one); err != nil {
+		return nil, err
+	}
+	return one, nil
+}
+
+/**
+ * 缓存 key 被 /rule/reset 删除后，从尚未处理的预留记录中移除该 key 的占用，之后的 cancel、超时退还不再作用于重置后的 key
+ * 记录以 WATCH 保证与其他修改不冲突；返回修改的预留数
+ */
+func (p *Policy) dropReservedKey(cacheKey string) (int, error) {
+	redisConn := p.redisConn()
+	defer redisConn.Close()
+
+	index := reserveKeyIndex(cacheKey)
+	tokens, err := redis.Strings(redisConn.Do("SMEMBERS", index))
+	if err != nil {
+		return 0, err
+	}
+	dropped := 0
+	for _, token := range tokens {
+		changed, err := dropReservedRules(redisConn, token, cacheKey)
+		if err != nil {
+			return dropped, err
+		}
+		if changed {
+			dropped++
+		}
+	}
+	if _, err := redisConn.Do("DEL", index); err != nil {
+		return dropped, err
+	}
+	return dropped, nil
+}
+
+/**
+ * 从一条预留记录中移除 cacheKey 的占用；记录在读写之间被修改时重试
+ */
+func dropReservedRules(redisConn redis.Conn, token string, cacheKey string) (bool, error) {
+	key := reserveRedisKey(token)
+	for i := 0; i < reserveDropRetry; i++ {
+		if _, err := redisConn.Do("WATCH", key); err != nil {
+			return false, err
+		}
+		record, err := redis.Bytes(redisConn.Do("GET", key))
+		if err == redis.ErrNil {
+			redisConn.Do("UNWATCH")
+			return false, nil
+		}
+		if err != nil {
+			redisConn.Do("UNWATCH")
+			return false, err
+		}
+		ttl, err := redis.Int64(redisConn.Do("PTTL", key))
+		if err != nil {
+			redisConn.Do("UNWATCH")
+			return false, err
+		}
+		one := new(reservation)
+		if err := json.Unmarshal(record, one); err != nil {
+			redisConn.Do("UNWATCH")
+			return false, err
+		}
+		rules := make([]reservedRule, 0, len(one.Rules))
+		for _, r := range one.Rules {
+			if r.CacheKey != cacheKey {
+				rules = append(rules, r)
+			}
+		}
+		if len(rules) == len(one.Rules) {
+			redisConn.Do("UNWATCH")
+			return false, nil
+		}
+		one.Rules = rules
+		if record, err = json.Marshal(one); err != nil {
+			redisConn.Do("UNWATCH")
+			return false, err
+		}
+		redisConn.Send("MULTI")
+		if ttl > 0 {
+			redisConn.Send("SET", key, record, "PX", ttl)
+		} else {
+			redisConn.Send("SET", key, record)
+		}
+		reply, err := redisConn.Do("EXEC")
+		if err != nil {
+			return false, err
+		}
+		// EXEC 返回 nil：记录已被修改，重新读取
+		if reply != nil {
+			return true, nil
+		}
+	}
+	return false, errors.New("reservation " + token + " changed concurrently")
+}
+
+/**
+ * 删除预留记录
+ */
+func (p *Policy) dropReservation(token string) error {
+	redisConn := p.redisConn()
+	defer redisConn.Close()
+
+	_, err := redisConn.Do("DEL", reserveRedisKey(token))
+	return err
+}
+
+/**
+ * 退还预留的全部占用并删除记录；返回是否全部退还成功
+ */
+func (p *Policy) cancelReservation(one *reservation, logHandle *utility.Logger) ([]reserveRefund, bool) {
+	results := p.refundReserved(one.Rules, logHandle)
+	allOK := true
+	for _, r := range results {
+		allOK = allOK && r.OK
+	}
+	if err := p.dropReservation(one.Token); err != nil {
+		logHandle.Warning("[errmsg=reservation drop failed, " + err.Error() + " token=" + one.Token + "]")
+	}
+	return results, allOK
+}
+
+/**
+ * /rule/commit、/rule/cancel 的公共部分：检查 token、取得处理权；失败时已输出结果
+ */
+func (p *Policy) reservationRequest(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) *reservation {
+	token := strings.Trim(request.Rstr("reservation"), emptyRunes)
+	if !validReserveToken(token) {
+		adminResponse(response, 400, -1, "invalid reservation token", nil)
+		return nil
+	}
+	one, err := p.takeReservation(token, true)
+	if err == errReservationNotFound {
+		adminResponse(response, 404, -1, err.Error(), nil)
+		return nil
+	}
+	if err != nil {
+		logHandle.Fatal("[errmsg=" + err.Error() + " token=" + token + "]")
+		adminResponse(response, 500, -1, err.Error(), nil)
+		return nil
+	}
+	return one
+}
+
+// DoRuleCommit 确认预留：保留浏览时（_reserve=yes）占用的额度
+// 参数 reservation 为浏览结果中的 Reservation；已经 commit、cancel 或超时退还的预留返回 404
+func (s *FrontServer) DoRuleCommit(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) {
+	localPolicy := CurrentPolicy()
+	one := localPolicy.reservationRequest(request, response, logHandle)
+	if one == nil {
+		return
+	}
+	if err := localPolicy.dropReservation(one.Token); err != nil {
+		logHandle.Warning("[errmsg=reservation drop failed, " + err.Error() + " token=" + one.Token + "]")
+	}
+	logHandle.Notice("[msg=reservation committed token=" + one.Token + " rules=" + strconv.Itoa(len(one.Rules)) + "]")
+	adminResponse(response, 200, 0, "OK", nil)
+}
+
+// DoRuleCancel 取消预留：退还浏览时（_reserve=yes）占用的额度
+// 参数同 /rule/commit；返回每条 rule 的退还结果，有 rule 退还失败时 errno 为 -1
+func (s *FrontServer) DoRuleCancel(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) {
+	localPolicy := CurrentPolicy()
+	one := localPolicy.reservationRequest(request, response, logHandle)
+	if one == nil {
+		return
+	}
+	results, allOK := localPolicy.cancelReservation(one, logHandle)
+	logHandle.Notice("[msg=reservation cancelled token=" + one.Token + " rules=" + strconv.Itoa(len(one.Rules)) + "]")
+	data := reserveCancelResult{Token: one.Token, Rules: results}
+	if !allOK {
+		adminResponse(response, 500, -1, "reservation refund failed", data)
+		return
+	}
+	adminResponse(response, 200, 0, "OK", data)
+}
+
+// ReserveAgent 预留超时处理协程
+// 每秒检查待处理集合，退还超时未 commit/cancel 的预留；多个 koala 实例同时运行时，每个预留只由一个实例退还
+func ReserveAgent() {
+	logHandle := utility.NewLogger("")
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		// 一批全部处理完时，可能还有更多超时的预留，继续处理
+		for CurrentPolicy().reserveSweep(logHandle) == reserveSweepBatch {
+			continue
+		}
+	}
+}
+
+/**
+ * 退还一批超时的预留；返回本批处理完成的数量（出错的不计，留待下次处理）
+ */
+func (p *Policy) reserveSweep(logHandle *utility.Logger) int {
+	redisConn := p.redisConn()
+	tokens, err := redis.Strings(redisConn.Do("ZRANGEBYSCORE", reserveRedisKey(reservePendingKey),
+		"-inf", time.Now().Unix(), "LIMIT", 0, reserveSweepBatch))
+	redisConn.Close()
+	if err != nil {
+		logHandle.Warning("[errmsg=reservation sweep failed, " + err.Error() + "]")
+		return 0
+	}
+
+	handled := 0
+	for _, token := range tokens {
+		one, err := p.takeReservation(token, false)
+		if err == errReservationNotFound {
+			// 已被其他实例处理，或恰好 commit/cancel
+			handled++
+			continue
+		}
+		if err != nil {
+			logHandle.Warning("[errmsg=reservation expire failed, " + err.Error() + " token=" + token + "]")
+			continue
+		}
+		p.cancelReservation(one, logHandle)
+		logHandle.Notice("[msg=reservation expired token=" + token + " rules=" + strconv.Itoa(len(one.Rules)) + "]")
+		handled++
+	}
+	return handled
+}
@@ -0,0 +1,172 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Quota reservation tests
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koala
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/heiyeluren/koala/utility"
+)
+
+// 测试用的规则：一秒的窗口内每个 uid 可以 ask 两次
+const testReserveRules = "[rules]\nrule : [count] [act=ask; uid=+;] [time=1; count=2;] [result=2; return=201]\n" + testPolicyResults
+
+/**
+ * 启动内存版 redis，返回连接它的引擎；测试结束时关闭
+ */
+func testRedisEngine(t *testing.T, rules string) (*miniredis.Miniredis, *Engine) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mr.Close)
+	engine, err := NewEngine(EngineOptions{RedisServer: mr.Addr()}, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { engine.Close() })
+	return mr, engine
+}
+
+/**
+ * 预留一次并保存记录，返回预留 token
+ */
+func testReserve(t *testing.T, policy *Policy, params map[string]string) string {
+	logHandle := utility.NewLogger("")
+	_, taken, err := policy.reserve(context.Background(), params, false, nil, logHandle)
+	if err != nil || len(taken) == 0 {
+		t.Fatalf("reserve: want quota taken, got %v, %v", taken, err)
+	}
+	token, err := policy.saveReservation(taken)
+	if err != nil {
+		t.Fatalf("save reservation: %v", err)
+	}
+	return token
+}
+
+func TestReservationCancel(t *testing.T) {
+	params := map[string]string{"act": "ask", "uid": "10001"}
+	cases := []struct {
+		name string
+		// 预留之后、取消之前的操作
+		between   func(t *testing.T, mr *miniredis.Miniredis, policy *Policy, cacheKey string)
+		refunds   []reserveRefund
+		wantCount string // 取消后计数 key 的值
+	}{
+		{
+			name:      "same window",
+			refunds:   []reserveRefund{{Return: 201, Method: "count", OK: true}},
+			wantCount: "0",
+		},
+		{
+			name: "window rolled over",
+			between: func(t *testing.T, mr *miniredis.Miniredis, policy *Policy, cacheKey string) {
+				// 窗口过期，新窗口中又占用了一次；退还不能扣减新窗口的计数
+				time.Sleep(1100 * time.Millisecond)
+				mr.FastForward(1100 * time.Millisecond)
+				testReserve(t, policy, params)
+			},
+			refunds:   []reserveRefund{{Return: 201, Method: "count", OK: true, Skipped: true}},
+			wantCount: "1",
+		},
+		{
+			name: "reset",
+			between: func(t *testing.T, mr *miniredis.Miniredis, policy *Policy, cacheKey string) {
+				// 同 /rule/reset：删除计数并移除预留中的占用，之后重新计数
+				if _, _, err := policy.ruleTable[0].reset(cacheKey); err != nil {
+					t.Fatal(err)
+				}
+				if dropped, err := policy.dropReservedKey(cacheKey); err != nil || dropped != 1 {
+					t.Fatalf("dropReservedKey: want 1 reservation, got %d, %v", dropped, err)
+				}
+				testReserve(t, policy, params)
+			},
+			refunds:   []reserveRefund{},
+			wantCount: "1",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mr, engine := testRedisEngine(t, testReserveRules)
+			policy := engine.policy
+			cacheKey := policy.ruleTable[0].getCacheKey(params)
+
+			token := testReserve(t, policy, params)
+			if c.between != nil {
+				c.between(t, mr, policy, cacheKey)
+			}
+			one, err := policy.takeReservation(token, true)
+			if err != nil {
+				t.Fatalf("take reservation: %v", err)
+			}
+			refunds, allOK := policy.cancelReservation(one, utility.NewLogger(""))
+			for i := range refunds {
+				refunds[i].CacheKey = ""
+			}
+			if !allOK || len(refunds) != len(c.refunds) || (len(refunds) > 0 && refunds[0] != c.refunds[0]) {
+				t.Errorf("refunds: want %+v, got %+v (all ok %v)", c.refunds, refunds, allOK)
+			}
+			if got, _ := mr.Get(cacheKey); got != c.wantCount {
+				t.Errorf("count after cancel: want %s, got %s", c.wantCount, got)
+			}
+			if mr.Exists(reserveRedisKey(token)) {
+				t.Errorf("reservation record not dropped")
+			}
+		})
+	}
+}
+
+func TestReservationDeadline(t *testing.T) {
+	mr, engine := testRedisEngine(t, testReserveRules)
+	policy := engine.policy
+	params := map[string]string{"act": "ask", "uid": "10001"}
+	cacheKey := policy.ruleTable[0].getCacheKey(params)
+
+	token := testReserve(t, policy, params)
+	// 预留已超时：commit、cancel 取不到，由超时处理退还
+	if _, err := mr.ZAdd(reserveRedisKey(reservePendingKey), float64(time.Now().Unix()-1), token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := policy.takeReservation(token, true); err != errReservationNotFound {
+		t.Fatalf("take expired reservation: want not found, got %v", err)
+	}
+	if handled := policy.reserveSweep(utility.NewLogger("")); handled != 1 {
+		t.Fatalf("sweep: want 1 reservation, got %d", handled)
+	}
+	if got, _ := mr.Get(cacheKey); got != "0" {
+		t.Errorf("count after sweep: want 0, got %s", got)
+	}
+	if _, err := policy.takeReservation(token, false); err != errReservationNotFound {
+		t.Errorf("take swept reservation: want not found, got %v", err)
+	}
+}
+
+func TestReservationPool(t *testing.T) {
+	_, engine := testRedisEngine(t, testReserveRules)
+	// 预留记录与计数使用引擎的连接池，而不是全局 RedisPool
+	if RedisPool != nil {
+		t.Skip("global RedisPool is set")
+	}
+	token := testReserve(t, engine.policy, map[string]string{"act": "ask", "uid": "10001"})
+	conn := engine.pool.Get()
+	defer conn.Close()
+	if exists, err := redis.Bool(conn.Do("EXISTS", reserveRedisKey(token))); err != nil || !exists {
+		t.Errorf("reservation record not saved through the engine pool: %v, %v", exists, err)
+	}
+}
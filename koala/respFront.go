@@ -0,0 +1,144 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Redis protocol (RESP) server front api
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koala
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heiyeluren/koala/utility"
+)
+
+// respCommands 命令与接口的对应关系
+// 单次命令的参数为 field value 对，如 KOALA.CHECK act ask uid 123；
+// 多重命令的每个参数为一个 job 的 json 对象（ID 字段为 job 标识），也可以只传一个 json 数组
+// 接口返回 200 时，回复为接口返回的 json 文本（bulk string）；否则为错误回复
+var respCommands = map[string]string{
+	"KOALA.CHECK":    "rule/browse",
+	"KOALA.CHECKALL": "rule/browse_complete",
+	"KOALA.UPDATE":   "rule/update",
+	"KOALA.MCHECK":   "multi/browse",
+	"KOALA.MUPDATE":  "multi/update",
+}
+
+// RespListen 在 resp_listen 端口上提供 redis 协议服务；未配置时直接返回
+func RespListen() {
+	address := Config.Get("resp_listen")
+	if address == "" {
+		return
+	}
+	tcpListener, err := utility.TcpListen(address)
+	if err != nil {
+		panic(err.Error())
+	}
+	for {
+		tcpConnection, err := tcpListener.Accept()
+		if err != nil {
+			continue
+		}
+		go RespDispatch(utility.NewRespConnection(tcpConnection))
+	}
+}
+
+// RespDispatch 处理一个 redis 协议长连接；pipeline 中的命令依次执行，读完已到达的命令后统一发送回复
+func RespDispatch(respConnection *utility.RespConnection) {
+	defer respConnection.Close()
+
+	idleTimeout := time.Duration(Config.GetInt("rpc_idle_timeout")) * time.Millisecond
+	if idleTimeout <= 0 {
+		idleTimeout = time.Minute
+	}
+	writeTimeout := time.Duration(Config.GetInt("externalWriteTimeout")) * time.Millisecond
+	remoteAddr := respConnection.RemoteAddr().String()
+	for {
+		args, err := respConnection.ReadCommand(idleTimeout)
+		if err != nil {
+			if err == utility.ErrRespProtocol {
+				respConnection.WriteError("ERR protocol error")
+				respConnection.Flush(writeTimeout)
+			}
+			return
+		}
+		quit := respCommand(respConnection, args, remoteAddr)
+		if respConnection.Buffered() == 0 || quit {
+			if err := respConnection.Flush(writeTimeout); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+/**
+ * 执行一条命令并写入回复；返回是否需要关闭连接（QUIT）
+ */
+func respCommand(respConnection *utility.RespConnection, args []string, remoteAddr string) bool {
+	name := strings.ToUpper(args[0])
+	switch name {
+	case "PING":
+		respConnection.WriteStatus("PONG")
+		return false
+	case "QUIT":
+		respConnection.WriteStatus("OK")
+		return true
+	}
+
+	path, OK := respCommands[name]
+	if !OK {
+		respConnection.WriteError("ERR unknown command '" + args[0] + "'")
+		return false
+	}
+	request := newFrontRequest(path, remoteAddr)
+	if strings.HasPrefix(path, "multi/") {
+		if len(args) < 2 {
+			respConnection.WriteError("ERR wrong number of arguments for '" + args[0] + "' command")
+			return false
+		}
+		jobs := args[1]
+		if len(args) > 2 || !strings.HasPrefix(strings.TrimSpace(jobs), "[") {
+			jobs = "[" + strings.Join(args[1:], ",") + "]"
+		}
+		if err := request.SetJSONBody([]byte(jobs)); err != nil {
+			respConnection.WriteError("ERR jobs must be json objects")
+			return false
+		}
+	} else {
+		if len(args)%2 != 1 {
+			respConnection.WriteError("ERR wrong number of arguments for '" + args[0] + "' command")
+			return false
+		}
+		posts := make(map[string]string, len(args)/2)
+		for i := 1; i < len(args); i += 2 {
+			posts[args[i]] = args[i+1]
+		}
+		request.SetPosts(posts)
+	}
+
+	response := utility.NewHttpResponse()
+	logHandle := utility.NewLogger("")
+	frontCall(request, response, logHandle)
+
+	if code, phrase := response.Status(); code != 200 {
+		message := "ERR " + strconv.Itoa(code) + " " + phrase
+		if body := response.BodyString(); body != "" {
+			message += " " + body
+		}
+		respConnection.WriteError(message)
+		return false
+	}
+	respConnection.WriteBulk(response.BodyString())
+	return false
+}
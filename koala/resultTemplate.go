@@ -0,0 +1,188 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Result message template
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koala
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 返回结果模板中的占位符；Err_msg、Str_reason 中可以使用，由判定结果的 rule 在查询时填充
+// 只有 {名称} 形式（名称为字母、数字、下划线，可带 param: 前缀）的才是占位符，其余花括号原样输出；
+// 字面的 {、} 可写作 {{、}}，如 {{rule}} 输出为 {rule}
+const (
+	templateLimit     = "limit"     // rule 的阀值，见 quota
+	templateUsed      = "used"      // 当前已计数值
+	templateRemaining = "remaining" // 剩余次数，不小于 0
+	templateResetIn   = "reset_in"  // 距离计数重置的秒数
+	templateRule      = "rule"      // rule 的 return 值
+	templateParam     = "param:"    // {param:xxx} 请求参数 xxx 的值
+)
+
+/**
+ * 是否需要填充（含占位符或 {{、}}）；不需要的结果原样返回，不额外查询缓存
+ */
+func (r RetValue) hasTemplate() bool {
+	return r.template
+}
+
+/**
+ * 检查模板中的占位符是否都能识别，并记录是否需要填充；解析 [result] 时调用
+ */
+func (r *RetValue) checkTemplate() error {
+	r.template = false
+	for _, text := range []string{r.ErrMsg, r.StrReason} {
+		var err error
+		// 占位符填充为空，{{、}} 变为单个字符：与原文不同即需要填充
+		filled := fillTemplate(text, func(name string) string {
+			switch {
+			case name == templateLimit, name == templateUsed, name == templateRemaining,
+				name == templateResetIn, name == templateRule:
+			case strings.HasPrefix(name, templateParam) && len(name) > len(templateParam):
+			default:
+				err = errors.New("result syntax error: unknown placeholder {" + name + "}")
+			}
+			return ""
+		})
+		if err != nil {
+			return err
+		}
+		r.template = r.template || filled != text
+	}
+	return nil
+}
+
+/**
+ * 填充模板；rule 为判定结果的规则，state 为其缓存状态
+ * rule 为空（默认结果、有匹配未命中）时，只填充 {param:xxx}，其余占位符为空
+ */
+func (r *RetValue) render(rule *Rule, state *RuleState, params map[string]string) {
+	if !r.hasTemplate() {
+		return
+	}
+	var limit, used, resetIn int64
+	if rule != nil && state != nil {
+		limit, used, resetIn = rule.quota(state)
+	}
+	value := func(name string) string {
+		if strings.HasPrefix(name, templateParam) {
+			return params[strings.TrimPrefix(name, templateParam)]
+		}
+		if rule == nil {
+			return ""
+		}
+		switch name {
+		case templateLimit:
+			return strconv.FormatInt(limit, 10)
+		case templateUsed:
+			return strconv.FormatInt(used, 10)
+		case templateRemaining:
+			if used >= limit {
+				return "0"
+			}
+			return strconv.FormatInt(limit-used, 10)
+		case templateResetIn:
+			return strconv.FormatInt(resetIn, 10)
+		case templateRule:
+			return strconv.Itoa(int(rule.returnCode))
+		}
+		return ""
+	}
+	r.ErrMsg = fillTemplate(r.ErrMsg, value)
+	r.StrReason = fillTemplate(r.StrReason, value)
+}
+
+/**
+ * 按 {name} 替换占位符；{{、}} 输出为 {、}，不是占位符形式的花括号、未闭合的 {、单独的 } 原样保留
+ */
+func fillTemplate(text string, value func(name string) string) string {
+	var filled strings.Builder
+	for {
+		start := strings.IndexAny(text, "{}")
+		if start < 0 {
+			break
+		}
+		if start+1 < len(text) && text[start+1] == text[start] {
+			filled.WriteString(text[:start+1])
+			text = text[start+2:]
+			continue
+		}
+		if text[start] == '}' {
+			filled.WriteString(text[:start+1])
+			text = text[start+1:]
+			continue
+		}
+		end := strings.Index(text[start:], "}")
+		if end < 0 {
+			break
+		}
+		name := text[start+1 : start+end]
+		if !isPlaceholder(name) {
+			filled.WriteString(text[:start+1])
+			text = text[start+1:]
+			continue
+		}
+		filled.WriteString(text[:start])
+		filled.WriteString(value(name))
+		text = text[start+end+1:]
+	}
+	filled.WriteString(text)
+	return filled.String()
+}
+
+/**
+ * 是否为占位符形式：名称（param: 之类的前缀之前的部分）非空，且只含字母、数字、下划线
+ */
+func isPlaceholder(name string) bool {
+	if i := strings.Index(name, ":"); i >= 0 {
+		name = name[:i]
+	}
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * 按规则类型，从缓存状态得出阀值、已计数值和距离重置的秒数
+ * count：计数 key；base：达到 base 之后的 _B 后缀 key
+ * leak：与 leakBrowse 一致，窗口内已有 count+1 个元素时超出限制；已计数为窗口内的元素数，重置时间为其中最早一个移出窗口的时间
+ */
+func (k *Rule) quota(state *RuleState) (limit, used, resetIn int64) {
+	limit = int64(k.count)
+	switch k.method {
+	case "count":
+		used, resetIn = state.Count, state.TTL
+	case "base":
+		used, resetIn = state.BaseCount, state.BaseTTL
+	case "leak":
+		limit = int64(k.count) + 1
+		used = state.LeakUsed
+		if state.LeakUsed > 0 {
+			resetIn = state.LeakOldest + int64(k.time) + 1 - time.Now().Unix()
+		}
+	default:
+	}
+	// TTL 为 -1（永久）、-2（不存在）时，视为无需等待
+	if resetIn < 0 {
+		resetIn = 0
+	}
+	return limit, used, resetIn
+}
@@ -0,0 +1,127 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Result template tests
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koala
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckTemplate(t *testing.T) {
+	cases := []struct {
+		name     string
+		errMsg   string
+		reason   string
+		template bool   // 期望需要填充
+		err      string // 期望的错误信息片段；为空时期望通过
+	}{
+		{name: "no placeholder", errMsg: "too many requests", reason: "Deny"},
+		{name: "all placeholders", errMsg: "{limit} {used} {remaining} {reset_in} {rule}", reason: "uid={param:uid}", template: true},
+		{name: "placeholder in reason only", reason: "{{rule}} {rule}", template: true},
+		{name: "unknown placeholder", errMsg: "retry in {reset_at}s", err: "unknown placeholder {reset_at}"},
+		{name: "typo in reason", reason: "limit {limt}", err: "unknown placeholder {limt}"},
+		{name: "empty param name", reason: "{param:}", err: "unknown placeholder {param:}"},
+		{name: "unknown prefix", reason: "{query:uid}", err: "unknown placeholder {query:uid}"},
+		{name: "json braces", errMsg: `{"code": 1}`, reason: "{ spaced }"},
+		{name: "escaped brace", reason: "{{limit} is literal", template: true},
+		{name: "escaped placeholder", reason: "{{rule}}", template: true},
+		{name: "unclosed brace", reason: "limit {limit"},
+		{name: "empty braces", reason: "{}"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ret := RetValue{ErrMsg: c.errMsg, StrReason: c.reason}
+			err := ret.checkTemplate()
+			if c.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if ret.hasTemplate() != c.template {
+					t.Errorf("hasTemplate() = %v, want %v", ret.hasTemplate(), c.template)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("want error containing %q, got %v", c.err, err)
+			}
+		})
+	}
+}
+
+func TestFillTemplate(t *testing.T) {
+	values := map[string]string{"limit": "5", "used": "2", "param:uid": "u1"}
+	value := func(name string) string {
+		return values[name]
+	}
+	cases := []struct {
+		name string
+		text string
+		want string
+	}{
+		{name: "plain", text: "Deny", want: "Deny"},
+		{name: "placeholders", text: "{used}/{limit} uid={param:uid}", want: "2/5 uid=u1"},
+		{name: "missing value", text: "[{remaining}]", want: "[]"},
+		{name: "escaped brace", text: "{{limit} = {limit}", want: "{limit} = 5"},
+		{name: "double escape", text: "{{{{", want: "{{"},
+		{name: "escaped placeholder", text: "{{limit}} = {limit}", want: "{limit} = 5"},
+		{name: "escaped closing brace", text: "}}}} {used}}}", want: "}} 2}"},
+		{name: "json braces", text: `{"used": {used}}`, want: `{"used": 2}`},
+		{name: "spaced braces", text: "{ limit }", want: "{ limit }"},
+		{name: "empty braces", text: "a{}b", want: "a{}b"},
+		{name: "unclosed", text: "limit {limit", want: "limit {limit"},
+		{name: "closing only", text: "}{used}}", want: "}2}"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := fillTemplate(c.text, value); got != c.want {
+				t.Errorf("fillTemplate(%q) = %q, want %q", c.text, got, c.want)
+			}
+		})
+	}
+}
+
+func TestRenderCountRule(t *testing.T) {
+	var rule Rule
+	if err := rule.Constructor(" [count] [act=ask; uid=+;] [time=60; count=5;] [result=2; return=201]", nil); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		rule   *Rule
+		state  *RuleState
+		reason string
+		want   string
+	}{
+		{name: "counted", rule: &rule, state: &RuleState{Count: 3, TTL: 42}, reason: "{used}/{limit} left {remaining} reset {reset_in}s rule {rule}", want: "3/5 left 2 reset 42s rule 201"},
+		{name: "over limit", rule: &rule, state: &RuleState{Count: 7, TTL: 1}, reason: "left {remaining}", want: "left 0"},
+		{name: "no rule", reason: "{limit}|{param:uid}", want: "|u1"},
+		{name: "escaped", rule: &rule, state: &RuleState{Count: 1}, reason: "{{rule}} {rule}", want: "{rule} 201"},
+		{name: "escape only", rule: &rule, state: &RuleState{Count: 1}, reason: "{ rule }}", want: "{ rule }"},
+		{name: "no placeholder", rule: &rule, state: &RuleState{Count: 1}, reason: `{"rule": 1}`, want: `{"rule": 1}`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ret := RetValue{StrReason: c.reason}
+			if err := ret.checkTemplate(); err != nil {
+				t.Fatal(err)
+			}
+			ret.render(c.rule, c.state, map[string]string{"uid": "u1"})
+			if ret.StrReason != c.want {
+				t.Errorf("render = %q, want %q", ret.StrReason, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Gob rpc server front api
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koala
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/heiyeluren/koala/utility"
+)
+
+// rpc 调用约定：
+// RpcRequest.Func 为接口路径（如 rule/browse、multi/update），Args 为请求参数，与 http 接口相同；
+// multi 类接口的 job 列表通过 Args["jobs"]（[]map[string]string）传入，也可以沿用 argsJson 参数
+// RpcResponse.Code 为 http 状态码，Result 为 Code == 200，Data 为接口返回的 json 文本
+// 一个连接上可以连续发送多个请求，按顺序返回
+const rpcJobsArg = "jobs"
+
+// RpcListen 在 rpc_listen 独立端口上提供 rpc 服务；listen 端口是否同样处理 rpc 请求见 rpc_sniff 配置
+func RpcListen() {
+	address := Config.Get("rpc_listen")
+	if address == "" {
+		return
+	}
+	tcpListener, err := utility.TcpListen(address)
+	if err != nil {
+		panic(err.Error())
+	}
+	for {
+		tcpConnection, err := tcpListener.Accept()
+		if err != nil {
+			continue
+		}
+		go RpcDispatch(utility.NewRpcConnection(tcpConnection))
+	}
+}
+
+// RpcDispatch 处理一个 rpc 长连接，直到客户端关闭、空闲超时或出错
+func RpcDispatch(rpcConnection *utility.RpcConnection) {
+	defer rpcConnection.Close()
+
+	idleTimeout := time.Duration(Config.GetInt("rpc_idle_timeout")) * time.Millisecond
+	if idleTimeout <= 0 {
+		idleTimeout = time.Minute
+	}
+	writeTimeout := time.Duration(Config.GetInt("externalWriteTimeout")) * time.Millisecond
+	remoteAddr := rpcConnection.RemoteAddr().String()
+	for {
+		rpcRequest, err := rpcConnection.ReadRequest(idleTimeout)
+		if err != nil {
+			return
+		}
+		rpcResponse := rpcCall(rpcRequest, remoteAddr)
+		if err := rpcConnection.WriteResponse(rpcResponse, writeTimeout); err != nil {
+			return
+		}
+	}
+}
+
+/**
+ * 把 rpc 请求转为 http 请求，调用对应的 FrontServer 接口
+ */
+func rpcCall(rpcRequest *utility.RpcRequest, remoteAddr string) *utility.RpcResponse {
+	request := newFrontRequest(rpcRequest.Func, remoteAddr)
+	posts := make(map[string]string, len(rpcRequest.Args))
+	for k, v := range rpcRequest.Args {
+		switch value := v.(type) {
+		case string:
+			posts[k] = value
+		case []map[string]string:
+			if k == rpcJobsArg {
+				request.SetPostList(value)
+			}
+		case nil:
+		default:
+			posts[k] = fmt.Sprint(value)
+		}
+	}
+	request.SetPosts(posts)
+
+	response := utility.NewHttpResponse()
+	logHandle := utility.NewLogger("")
+	frontCall(request, response, logHandle)
+
+	rpcResponse := utility.NewRpcResponse()
+	rpcResponse.Code, rpcResponse.Reason = response.Status()
+	rpcResponse.Result = rpcResponse.Code == 200
+	rpcResponse.Data = response.BodyString()
+	return rpcResponse
+}
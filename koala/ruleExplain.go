@@ -0,0 +1,146 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Rule decision explain api
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koala
+
+import (
+	"sort"
+
+	"github.com/heiyeluren/koala/utility"
+)
+
+// keyExplain 单个 key 的匹配情况
+type keyExplain struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	Expr    string `json:"expr"`
+	Matched bool   `json:"matched"`
+	Reason  string `json:"reason"`
+}
+
+// ruleThreshold rule 的阀值配置
+type ruleThreshold struct {
+	Base   int32 `json:"base,omitempty"`
+	Time   int32 `json:"time"`
+	Count  int32 `json:"count"`
+	Result int32 `json:"result"`
+}
+
+// ruleExplain 单条 rule 的判定过程
+type ruleExplain struct {
+	Return    int32         `json:"return"`
+	Method    string        `json:"method"`
+	Rule      string        `json:"rule"`
+	Matched   bool          `json:"matched"`
+	Keys      []keyExplain  `json:"keys"`
+	CacheKey  string        `json:"cache_key,omitempty"`
+	State     *RuleState    `json:"state,omitempty"`
+	Threshold ruleThreshold `json:"threshold"`
+	IsOut     bool          `json:"is_out"`
+	Decided   bool          `json:"decided"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// explainResult 判定过程的整体结果
+type explainResult struct {
+	DecidedBy int32         `json:"decided_by"`
+	Result    RetValue      `json:"result"`
+	Rules     []ruleExplain `json:"rules"`
+}
+
+/**
+ * 逐个 key 给出匹配情况（不在首个不匹配处中断）；全部匹配时返回 true
+ */
+func (k *Rule) explainKeys(params map[string]string) ([]keyExplain, bool) {
+	keyNames := make([]string, 0, len(k.keys))
+	for keyName := range k.keys {
+		keyNames = append(keyNames, keyName)
+	}
+	sort.Strings(keyNames)
+
+	satisfied := true
+	keys := make([]keyExplain, 0, len(keyNames))
+	for _, keyName := range keyNames {
+		key := k.keys[keyName]
+		one := keyExplain{Name: keyName, Value: params[keyName], Expr: key.dump()}
+		switch {
+		case one.Value == "":
+			one.Reason = "param not passed"
+		case key.matches(one.Value):
+			one.Matched = true
+			one.Reason = "value matches"
+		default:
+			one.Reason = "value not matches"
+		}
+		satisfied = satisfied && one.Matched
+		keys = append(keys, one)
+	}
+	return keys, satisfied
+}
+
+// DoRuleExplain 判定过程解释接口
+// 参数同 /rule/browse；按与 DoRuleBrowse 相同的顺序逐条 rule 给出匹配、缓存状态和判定情况
+// 说明：只读取缓存，不更新计数、不做 leak 清理、不计入策略统计
+func (s *FrontServer) DoRuleExplain(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) {
+	// 本地策略指针，可避免匹配过程中Global策略被替换 导致不一致
+	var localPolicy = CurrentPolicy()
+
+	params := request.Params()
+	result := explainResult{Result: localPolicy.retValueTable[0], Rules: make([]ruleExplain, 0, len(localPolicy.ruleTable))}
+	decided := false
+	for i := range localPolicy.ruleTable {
+		singleRule := &localPolicy.ruleTable[i]
+		one := ruleExplain{
+			Return: singleRule.returnCode,
+			Method: singleRule.method,
+			Rule:   singleRule.dump(),
+			Threshold: ruleThreshold{
+				Base:   singleRule.base,
+				Time:   singleRule.time,
+				Count:  singleRule.count,
+				Result: singleRule.result,
+			},
+		}
+		one.Keys, one.Matched = singleRule.explainKeys(params)
+		if one.Matched {
+			one.CacheKey = singleRule.getCacheKey(params)
+			state, err := singleRule.inspect(one.CacheKey)
+			if err != nil {
+				logHandle.Fatal("[errmsg=" + err.Error() + "]")
+				one.Error = err.Error()
+			} else {
+				one.State = state
+				one.IsOut = singleRule.isOut(state)
+			}
+
+			// 与 DoRuleBrowse 一致：首个超出限制的 rule 决定结果，否则为“有匹配但未命中”
+			if !decided {
+				if one.IsOut {
+					decided = true
+					one.Decided = true
+					result.DecidedBy = singleRule.returnCode
+					result.Result = localPolicy.retValueTable[int(singleRule.result)]
+					result.Result.RetCode = singleRule.returnCode
+					result.Result.render(singleRule, one.State, params)
+				} else {
+					result.Result = localPolicy.retValueTable[1]
+				}
+			}
+		}
+		result.Rules = append(result.Rules, one)
+	}
+	if !decided {
+		result.Result.render(nil, nil, params)
+	}
+
+	adminResponse(response, 200, 0, "OK", result)
+}
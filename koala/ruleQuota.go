@@ -0,0 +1,120 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Rate-limit quota in browse result
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koala
+
+import (
+	"strings"
+	"time"
+
+	"github.com/heiyeluren/koala/utility"
+)
+
+// RetQuota .
+// 限额信息，用于客户端展示剩余次数、设置 HTTP 429 的 Retry-After
+// 请求参数 _quota=yes，或请求命中 quota_namespaces 配置的命名空间时，附加在浏览结果中
+type RetQuota struct {
+	Limit      int64 `json:"Limit"`      // rule 的 count 阀值（leak 规则为 count+1）；direct 规则为 0
+	Remaining  int64 `json:"Remaining"`  // 剩余次数，不小于 0
+	ResetAt    int64 `json:"ResetAt"`    // 计数重置的 unix 时间戳；0 表示当前没有计数周期
+	RetryAfter int64 `json:"RetryAfter"` // 超出限制时，距离可重试的秒数；未超出限制时为 0
+}
+
+/**
+ * 判断本次请求是否需要附带限额信息；params 为请求参数（/multi/browse 为单个 job 的参数）
+ * 命名空间按请求参数 quota_namespace_param（默认 act）的值，与 quota_namespaces 逐个比较
+ */
+func quotaRequested(params map[string]string) bool {
+	if params["_quota"] == "yes" {
+		return true
+	}
+	namespaces := Config.Get("quota_namespaces")
+	if namespaces == "" {
+		return false
+	}
+	param := Config.Get("quota_namespace_param")
+	if param == "" {
+		param = "act"
+	}
+	namespace := params[param]
+	if namespace == "" {
+		return false
+	}
+	for _, v := range strings.Split(namespaces, ",") {
+		if strings.Trim(v, emptyRunes) == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * 由规则的缓存状态得出限额信息；isOut 为本次判定是否超出限制
+ */
+func (k *Rule) retQuota(state *RuleState, isOut bool) *RetQuota {
+	limit, used, resetIn := k.quota(state)
+	quota := &RetQuota{Limit: limit}
+	if used < limit {
+		quota.Remaining = limit - used
+	}
+	if isOut {
+		quota.Remaining = 0
+		quota.RetryAfter = resetIn
+	}
+	if resetIn > 0 {
+		quota.ResetAt = time.Now().Unix() + resetIn
+	}
+	return quota
+}
+
+/**
+ * 多条 rule 都有匹配时，取最紧的限额：剩余次数少者优先，相同时重置时间晚者优先
+ */
+func tighterQuota(a, b *RetQuota) *RetQuota {
+	if a == nil {
+		return b
+	}
+	if b.Remaining < a.Remaining || (b.Remaining == a.Remaining && b.ResetAt > a.ResetAt) {
+		return b
+	}
+	return a
+}
+
+/**
+ * 读取规则的缓存状态，供限额信息、结果模板使用；读取失败时记录日志，按空状态处理
+ */
+func ruleState(singleRule *Rule, cacheKey string, logHandle *utility.Logger) *RuleState {
+	state, err := singleRule.inspect(cacheKey)
+	if err != nil {
+		logHandle.Warning("[errmsg=rule state inspect failed, " + err.Error() + " cachekey=" + cacheKey + "]")
+		return new(RuleState)
+	}
+	return state
+}
+
+/**
+ * 批量读取规则多个 key 的缓存状态，一次发送；读取失败时记录日志，全部按空状态处理
+ * 返回的 map 中总有每个 key 的状态
+ */
+func ruleStates(singleRule *Rule, cacheKeys []string, logHandle *utility.Logger) map[string]*RuleState {
+	states, err := singleRule.multiInspect(cacheKeys)
+	if err != nil {
+		logHandle.Warning("[errmsg=rule state inspect failed, " + err.Error() + " cachekeys=" + strings.Join(cacheKeys, ",") + "]")
+		states = make(map[string]*RuleState, len(cacheKeys))
+	}
+	for _, key := range cacheKeys {
+		if states[key] == nil {
+			states[key] = new(RuleState)
+		}
+	}
+	return states
+}
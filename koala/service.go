@@ -13,6 +13,7 @@
 package koala
 
 import (
+	"context"
 	"encoding/json"
 	"net/url"
 	"strconv"
@@ -23,70 +24,31 @@ import (
 
 // DoRuleBrowse 查询访问接口
 func (s *FrontServer) DoRuleBrowse(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) {
-	// 本地策略指针，可避免匹配过程中Global策略被替换 导致不一致
-	var localPolicy = GlobalPolicy
-
-	var singleRule Rule
-	var err error
-	var retValue = localPolicy.retValueTable[0]
-	// 匹配每一条rule规则
-	for _, singleRule = range localPolicy.ruleTable {
-		var satisfied = true
-		// 遍历每个key，若不匹配或者参数未传，不命中
-		for k, v := range singleRule.keys {
-			str := request.Gstr(k)
-			if str != "" && v.matches(str) {
-				continue
-			}
-			satisfied = false
-			break
-		}
-		if !satisfied {
-			continue
+	// 请求参数：query string 与请求体（表单或 json）合并
+	var params = request.Params()
+	// _reserve=yes 时为预留查询：未超出限制时占用额度并返回预留 token，见 reservation.go
+	if request.Rstr("_reserve") == "yes" {
+		retValue := ruleReserveLogic(params, logHandle)
+		retString, err := json.Marshal(retValue)
+		if err != nil {
+			response.SetCode(500)
+			return
 		}
-
-		// 对命中的key，查缓存值，与阀值比较，判断是否超出限制
-		var isOut bool
-		ruleCacheKey := singleRule.getCacheKey(request.Gets())
-		// println(ruleCacheKey)
-		switch singleRule.method {
-		case "direct":
-			isOut = true
-		case "count":
-			if isOut, err = singleRule.countBrowse(ruleCacheKey); err != nil {
-				logHandle.Fatal("[errmsg=" + err.Error() + "]")
-			}
-		case "base":
-			if isOut, err = singleRule.baseBrowse(ruleCacheKey); err != nil {
-				logHandle.Fatal("[errmsg=" + err.Error() + "]")
-			}
-		case "leak":
-			if isOut, err = singleRule.leakBrowse(ruleCacheKey); err != nil {
-				logHandle.Fatal("[errmsg=" + err.Error() + "]")
-			}
-		default:
-		}
-
-		// 统计，记录策略判定数据
-		CounterClient(singleRule.returnCode, isOut)
-
-		// 超出限制，按照rule的约定，给出处置策略
-		if isOut {
-			retValue = localPolicy.retValueTable[int(singleRule.result)]
-			retValue.RetCode = singleRule.returnCode
-			break
-		}
-		retValue = localPolicy.retValueTable[1]
+		response.Puts(string(retString))
+		response.SetCode(200)
+		return
 	}
 
+	// 本地策略指针，可避免匹配过程中Global策略被替换 导致不一致；查询出错已记录日志，按未超出限制返回
+	retValue, _ := CurrentPolicy().browse(context.Background(), params, quotaRequested(params), recordDecision, logHandle)
+
 	// _writeThrough“直接写缓存”开关，同时完成 Browse和 Update两步操作。
-	if retValue.RetType >= 1 && request.Gstr("_writeThrough") == "yes" {
+	if retValue.RetType >= 1 && request.Rstr("_writeThrough") == "yes" {
 		go RuleUpdateLogic(request, logHandle)
 	}
 
 	// 返回json结果
-	var retString []byte
-	retString, err = json.Marshal(retValue)
+	retString, err := json.Marshal(retValue)
 	if err != nil {
 		response.SetCode(500)
 		return
@@ -96,115 +58,122 @@ func (s *FrontServer) DoRuleBrowse(request *utility.HttpRequest, response *utili
 	response.SetCode(200)
 }
 
+// ruleUpdateResult 单条 rule 的更新结果
+type ruleUpdateResult struct {
+	Return    int32  `json:"return"`
+	Method    string `json:"method"`
+	OK        bool   `json:"ok"`
+	Duplicate bool   `json:"duplicate,omitempty"` // 同一 _reqid 已经更新过，本次跳过
+	Error     string `json:"error,omitempty"`
+}
+
+// syncUpdateResult 同步更新的返回结果；任一 rule 更新失败时 err_no 不为 0
+type syncUpdateResult struct {
+	ErrNo  int                `json:"err_no"`
+	ErrMsg string             `json:"err_msg"`
+	Rules  []ruleUpdateResult `json:"rules"`
+}
+
 // DoRuleUpdate 更新访问接口
+// 默认异步更新，立即返回；_sync=yes（或配置 update_sync = yes 且未传 _sync=no）时，
+// 完成更新后返回每条 rule 的更新结果，便于调用方在缓存写入失败时重试
 func (s *FrontServer) DoRuleUpdate(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) {
-	go RuleUpdateLogic(request, logHandle)
+	sync := Config.Get("update_sync") == "yes"
+	if v := request.Rstr("_sync"); v != "" {
+		sync = v == "yes"
+	}
+	if !sync {
+		go RuleUpdateLogic(request, logHandle)
 
-	response.Puts(`{"err_no":0, "err_msg":"OK"}`)
-	response.SetCode(200)
+		response.Puts(`{"err_no":0, "err_msg":"OK"}`)
+		response.SetCode(200)
+		return
+	}
+
+	result := syncUpdateResult{ErrMsg: "OK", Rules: RuleUpdateLogic(request, logHandle)}
+	code := 200
+	for _, one := range result.Rules {
+		if !one.OK {
+			result.ErrNo, result.ErrMsg = -1, "update failed"
+			code = 500
+			break
+		}
+	}
+	retString, err := json.Marshal(result)
+	if err != nil {
+		response.SetCode(500)
+		return
+	}
+	response.Puts(string(retString))
+	response.SetCode(code)
 }
 
-/**
- *    查询缓存状态接口
- */
-/*
-func (s *FrontServer) DoRuleValue(request *network.HttpRequest, response *network.HttpResponse, logHandle *logger.Logger) {
-    var localPolicy *Policy = GlobalPolicy
-
-    var singleRule KoalaRule
-    var err error
-    var cacheVal int = -1
-    var req_rule int32 = int32(request.Gint("rule_no"))
-    for _, singleRule = range localPolicy.ruleTable {
-        if singleRule.returnCode != req_rule {
-            continue
-        }
-        ruleCacheKey := singleRule.getCacheKey(request.Gets())
-        if cacheVal, err = singleRule.getCacheValue(ruleCacheKey); err != nil {
-            logHandle.Fatal("[errmsg=" + err.Error() + "]")
-            response.Puts(`{"err_no":-1, "err_msg":"system error!"}`)
-            response.SetCode(500)
-            break
-        }
-    }
-    if cacheVal == -1 {
-        response.Puts(`{"err_no":-2, "err_msg":"unknown rule_no!"}`)
-        response.SetCode(400)
-    } else {
-        response.Puts(`{"err_no":0, "err_msg":"", "cache_val":` + strconv.Itoa(cacheVal) + `}`)
-        response.SetCode(200)
-    }
+// ruleValue 单条匹配 rule 的缓存状态
+type ruleValue struct {
+	Return   int32      `json:"return"`
+	Method   string     `json:"method"`
+	CacheKey string     `json:"cache_key,omitempty"`
+	State    *RuleState `json:"state,omitempty"`
+	Quota    *RetQuota  `json:"quota,omitempty"`
+	IsOut    bool       `json:"is_out"`
+	Error    string     `json:"error,omitempty"`
 }
-*/
 
-// DoRuleBrowseComplete 非中断查询接口（可命中、并返回多条策略）
-func (s *FrontServer) DoRuleBrowseComplete(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) {
+// DoRuleValue 查询缓存状态接口
+// 参数同 /rule/browse；对每条匹配的 rule 给出缓存 key、计数值、_B 后缀计数值、leak 列表长度及剩余有效期
+// rule_no 指定 return 值时，只查看该条 rule；只读取缓存，不更新计数、不计入策略统计
+func (s *FrontServer) DoRuleValue(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) {
 	// 本地策略指针，可避免匹配过程中Global策略被替换 导致不一致
-	var localPolicy *Policy = GlobalPolicy
-
-	var singleRule Rule
-	var err error
-	// 用于返回多个结果，RetValue数组
-	var retArray []RetValue
-	var retValue = localPolicy.retValueTable[0]
-	// 匹配每一条rule规则
-	for _, singleRule = range localPolicy.ruleTable {
-		var satisfied = true
-		// 遍历每个key，若不匹配或者参数未传，跳过
-		for k, v := range singleRule.keys {
-			str := request.Gstr(k)
-			if str != "" && v.matches(str) {
-				continue
-			}
-			satisfied = false
-			break
+	var localPolicy = CurrentPolicy()
+
+	params := request.Params()
+	ruleNo := int32(request.Rint("rule_no"))
+	values := make([]ruleValue, 0, len(localPolicy.ruleTable))
+	for i := range localPolicy.ruleTable {
+		singleRule := &localPolicy.ruleTable[i]
+		if ruleNo != 0 && singleRule.returnCode != ruleNo {
+			continue
 		}
-		if !satisfied {
+		if !singleRule.satisfied(params) {
 			continue
 		}
-
-		// 对匹配的key，查缓存值，与阀值比较，判断是否超出限制
-		var isOut bool
-		switch singleRule.method {
-		case "direct":
-			isOut = true
-		case "count":
-			ruleCacheKey := singleRule.getCacheKey(request.Gets())
-			if isOut, err = singleRule.countBrowse(ruleCacheKey); err != nil {
-				logHandle.Fatal("[errmsg=" + err.Error() + "]")
-			}
-		case "base":
-			ruleCacheKey := singleRule.getCacheKey(request.Gets())
-			if isOut, err = singleRule.baseBrowse(ruleCacheKey); err != nil {
-				logHandle.Fatal("[errmsg=" + err.Error() + "]")
-			}
-		default:
+		one := ruleValue{Return: singleRule.returnCode, Method: singleRule.method}
+		if singleRule.method != "direct" {
+			one.CacheKey = singleRule.getCacheKey(params)
 		}
-
-		// 统计，记录策略判定数据
-		CounterClient(singleRule.returnCode, isOut)
-
-		// 命中，拼装结果
-		if isOut {
-			retValue = localPolicy.retValueTable[int(singleRule.result)]
-			retValue.RetCode = singleRule.returnCode
-			retArray = append(retArray, retValue)
+		state, err := singleRule.inspect(one.CacheKey)
+		if err != nil {
+			logHandle.Fatal("[errmsg=" + err.Error() + " cachekey=" + one.CacheKey + "]")
+			one.Error = err.Error()
+		} else {
+			one.State = state
+			one.IsOut = singleRule.isOut(state)
+			one.Quota = singleRule.retQuota(state, one.IsOut)
 		}
+		values = append(values, one)
 	}
 
-	// 如果没有命中任何策略，返回默认值
-	if retValue.RetType == 0 {
-		retArray = append(retArray, retValue)
+	if ruleNo != 0 && len(values) == 0 {
+		adminResponse(response, 400, -2, "unknown rule_no or rule not matched!", nil)
+		return
 	}
+	adminResponse(response, 200, 0, "OK", values)
+}
+
+// DoRuleBrowseComplete 非中断查询接口（可命中、并返回多条策略）
+func (s *FrontServer) DoRuleBrowseComplete(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) {
+	// 请求参数：query string 与请求体（表单或 json）合并
+	var params = request.Params()
+	// 本地策略指针，可避免匹配过程中Global策略被替换 导致不一致；查询出错已记录日志，按未超出限制返回
+	retArray, _ := CurrentPolicy().browseComplete(context.Background(), params, quotaRequested(params), recordDecision, logHandle)
 
 	// _writeThrough“直接写缓存”开关，同时完成 Browse和 Update两步操作。
-	if retValue.RetType <= 1 && request.Gstr("_writeThrough") == "yes" {
+	if retArray[len(retArray)-1].RetType <= 1 && request.Rstr("_writeThrough") == "yes" {
 		RuleUpdateLogic(request, logHandle)
 	}
 
 	// 返回json结果
-	var retString []byte
-	retString, err = json.Marshal(retArray)
+	retString, err := json.Marshal(retArray)
 	if err != nil {
 		response.SetCode(500)
 		return
@@ -214,97 +183,79 @@ func (s *FrontServer) DoRuleBrowseComplete(request *utility.HttpRequest, respons
 	response.SetCode(200)
 }
 
-/**
- *    反馈-feedback-接口
- */
-/*
-func (s *FrontServer) DoRuleFeedback(request *network.HttpRequest, response *network.HttpResponse, logHandle *logger.Logger) {
-
-    var localPolicy *Policy = GlobalPolicy
-
-    var singleRule KoalaRule
-    var feedbackType = request.Gstr("_feedbackType")
-    // 匹配每一条rule规则
-    for _, singleRule = range localPolicy.ruleTable {
-        var satisfied = true
-        // 遍历每个key，若不匹配或者参数未传，不命中
-        for k, v := range singleRule.keys {
-            str := request.Gstr(k)
-            if str != "" && v.matches(str) {
-                continue
-            }
-            satisfied = false
-            break
-        }
-        if !satisfied {
-            continue
-        }
-
-        var feedback int32
-        switch feedbackType {
-        case "erase1":
-            feedback = singleRule.erase1
-        case "erase2":
-            feedback = singleRule.erase2
-        default:
-            feedback = singleRule.erase1
-        }
-
-        ruleCacheKey := singleRule.getCacheKey(request.Gets())
-        go singleRule.leakFeedback(ruleCacheKey, int(feedback))
-    }
-
-    response.Puts(`{"err_no":0, "err_msg":"OK"}`)
-    response.SetCode(200)
+// ruleFeedback 单条 rule 的反馈结果
+type ruleFeedback struct {
+	Return   int32  `json:"return"`
+	Method   string `json:"method"`
+	CacheKey string `json:"cache_key"`
+	Erase    int32  `json:"erase"`
+	Before   int64  `json:"before"`
+	After    int64  `json:"after"`
+	Error    string `json:"error,omitempty"`
 }
-*/
 
-// RuleUpdateLogic 更新操作执行函数
-func RuleUpdateLogic(request *utility.HttpRequest, logHandle *utility.Logger) {
+// DoRuleFeedback 行为反馈接口
+// 参数同 /rule/update；_feedbackType 为 erase1（默认）或 erase2，按匹配 rule 配置的 erase1/erase2 数量回退计数：
+// leak 规则移除桶内最新的若干元素，count 规则减少计数值；均不会低于 0，未配置 erase 值的 rule 跳过
+func (s *FrontServer) DoRuleFeedback(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) {
 	// 本地策略指针，可避免匹配过程中Global策略被替换 导致不一致
-	var localPolicy *Policy = GlobalPolicy
+	var localPolicy = CurrentPolicy()
 
+	var feedbackType = request.Rstr("_feedbackType")
+	if feedbackType != "erase2" {
+		feedbackType = "erase1"
+	}
+	params := request.Params()
+	results := []ruleFeedback{}
 	// 匹配每一条rule规则
-	var singleRule Rule
-	for _, singleRule = range localPolicy.ruleTable {
-		var satisfied = true
-		// 遍历每个key，若不匹配或者参数未传，不命中
-		for k, v := range singleRule.keys {
-			s := request.Gstr(k)
-			if s != "" && v.matches(s) {
-				continue
-			}
-			satisfied = false
-			break
+	for i := range localPolicy.ruleTable {
+		singleRule := &localPolicy.ruleTable[i]
+		if singleRule.method != "leak" && singleRule.method != "count" {
+			continue
 		}
-		if !satisfied {
+		if !singleRule.satisfied(params) {
 			continue
 		}
 
-		ruleCacheKey := singleRule.getCacheKey(request.Gets())
-		// 更新cache值
-		switch singleRule.method {
-		case "count":
-			if singleRule.count == 0 {
-				continue
-			}
-			if err := singleRule.countUpdate(ruleCacheKey); err != nil {
-				logHandle.Fatal("[errmsg=" + err.Error() + "]")
-				continue
-			}
-		case "base":
-			if err := singleRule.baseUpdate(ruleCacheKey); err != nil {
-				logHandle.Fatal("[errmsg=" + err.Error() + "]")
-				continue
-			}
-		case "leak":
-			if err := singleRule.leakUpdate(ruleCacheKey); err != nil {
-				logHandle.Fatal("[errmsg=" + err.Error() + "]")
-				continue
-			}
-		default:
+		var feedback = singleRule.erase1
+		if feedbackType == "erase2" {
+			feedback = singleRule.erase2
+		}
+		if feedback <= 0 {
+			continue
+		}
+
+		one := ruleFeedback{
+			Return:   singleRule.returnCode,
+			Method:   singleRule.method,
+			CacheKey: singleRule.getCacheKey(params),
+			Erase:    feedback,
 		}
+		var err error
+		if singleRule.method == "leak" {
+			one.Before, one.After, err = singleRule.leakFeedback(one.CacheKey, int(feedback))
+		} else {
+			one.Before, one.After, err = singleRule.countFeedback(one.CacheKey, int(feedback))
+		}
+		if err != nil {
+			logHandle.Fatal("[errmsg=" + err.Error() + " cachekey=" + one.CacheKey + "]")
+			one.Error = err.Error()
+		} else {
+			logHandle.Notice("[msg=rule feedback return=" + strconv.Itoa(int(one.Return)) + " method=" + one.Method +
+				" cachekey=" + one.CacheKey + " type=" + feedbackType + " erase=" + strconv.Itoa(int(feedback)) +
+				" before=" + strconv.FormatInt(one.Before, 10) + " after=" + strconv.FormatInt(one.After, 10) + "]")
+		}
+		results = append(results, one)
 	}
+
+	adminResponse(response, 200, 0, "OK", results)
+}
+
+// RuleUpdateLogic 更新操作执行函数；返回每条更新了计数的 rule 的结果（direct 等无需更新的 rule 不在其中）
+func RuleUpdateLogic(request *utility.HttpRequest, logHandle *utility.Logger) []ruleUpdateResult {
+	// 本地策略指针，可避免匹配过程中Global策略被替换 导致不一致
+	results, _ := CurrentPolicy().update(context.Background(), request.Params(), logHandle)
+	return results
 }
 
 // DoMonitorAlive 监控连接redis是否成功
@@ -321,10 +272,17 @@ func (s *FrontServer) DoMonitorAlive(request *utility.HttpRequest, response *uti
 	response.SetCode(200)
 }
 
+// DoMonitorEvents 判定事件计数：缓冲中的事件数、已发送数、丢弃数（缓冲已满或发送失败）
+func (s *FrontServer) DoMonitorEvents(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) {
+	adminResponse(response, 200, 0, "OK", currentEventStats())
+}
+
 // Job .
+// Arg 为 urlencode 的参数串；json 数组请求体中的 job 直接给出参数对象，见 parseJobs()
 type Job struct {
-	ID  string
-	Arg string
+	ID   string
+	Arg  string
+	args map[string]string
 }
 
 // JobResult .
@@ -335,29 +293,77 @@ type JobResult struct {
 
 // JobBuffer .
 type JobBuffer struct {
-	ID       string
-	args     map[string]string
-	key      string
-	status   bool
-	decision int
-	retCode  int32
+	ID        string
+	args      map[string]string
+	key       string
+	status    bool
+	decision  int
+	retCode   int32
+	rule      *Rule     // 判定结果的 rule
+	ruleKey   string    // 判定结果的 rule 的缓存 key
+	withQuota bool      // 是否附带限额信息
+	quota     *RetQuota // 限额信息，规则同 DoRuleBrowse
 }
 
-// DoMultiBrowse 多重浏览访问接口
-func (s *FrontServer) DoMultiBrowse(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) {
-	argsJSON := request.Gstr("argsJson")
+// JobUpdateResult .
+// 多重更新中单个 job 的结果；Status 为 false 表示至少一条 rule 的计数未能更新
+type JobUpdateResult struct {
+	ID        string
+	Status    bool
+	Updated   []int32 // 已更新计数的 rule（return 值）
+	Failed    []int32 // 更新失败的 rule（return 值）
+	Duplicate []int32 // 同一 _reqid 已经更新过、本次跳过的 rule（return 值）
+}
+
+/**
+ * 解析多重接口的 job 列表；参数缺失或格式错误时返回 false
+ * 两种形式：
+ * argsJson 参数（query string 或表单），[{"ID":"1","Arg":"urlencode 的参数串"}, ...]
+ * application/json 数组请求体，每个元素为一个 job 的平铺参数对象，ID 字段为 job 标识，缺省时为数组下标
+ */
+func parseJobs(request *utility.HttpRequest, logHandle *utility.Logger) ([]Job, bool) {
+	if postList := request.PostList(); postList != nil {
+		jobs := make([]Job, 0, len(postList))
+		for i, args := range postList {
+			job := Job{ID: strconv.Itoa(i), args: args}
+			if id, OK := args["ID"]; OK {
+				job.ID = id
+				delete(args, "ID")
+			}
+			values := url.Values{}
+			for k, v := range args {
+				values.Set(k, v)
+			}
+			job.Arg = values.Encode()
+			jobs = append(jobs, job)
+		}
+		return jobs, true
+	}
+
+	argsJSON := request.Rstr("argsJson")
 	if argsJSON == "" {
-		response.SetCode(400)
-		return
+		return nil, false
 	}
 
 	var jobs []Job
-	err := json.Unmarshal([]byte(argsJSON), &jobs)
-	if err != nil {
+	if err := json.Unmarshal([]byte(argsJSON), &jobs); err != nil {
 		logHandle.Fatal("[errmsg=" + err.Error() + "]")
+		return nil, false
+	}
+	for i := range jobs {
+		jobs[i].args = parseJobArgs(jobs[i].Arg)
+	}
+	return jobs, true
+}
+
+// DoMultiBrowse 多重浏览访问接口
+func (s *FrontServer) DoMultiBrowse(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) {
+	jobs, OK := parseJobs(request, logHandle)
+	if !OK {
 		response.SetCode(400)
 		return
 	}
+	var err error
 
 	var logMsg string = ""
 	logMsg += "[ cip=" + request.GetRemoteIP()
@@ -368,88 +374,69 @@ func (s *FrontServer) DoMultiBrowse(request *utility.HttpRequest, response *util
 	for _, job := range jobs {
 		var buf JobBuffer
 		buf.ID = job.ID
-		buf.args = parseJobArgs(job.Arg)
+		buf.args = job.args
 		buf.status = false
 		buf.decision = 0
+		buf.withQuota = quotaRequested(buf.args)
 		buffers = append(buffers, buf)
 		logMsg += " ID" + job.ID + "@" + job.Arg
 	}
 	logMsg += " ] ["
 
-	var localPolicy = GlobalPolicy
-	var singleRule Rule
-	for _, singleRule = range localPolicy.ruleTable {
-		var cacheKeys []interface{}
-		for i, buf := range buffers {
-			buffers[i].key = ""
-			var satisfied = true
-			for k, v := range singleRule.keys {
-				str, OK := buf.args[k]
-				if OK && v.matches(str) {
-					continue
-				}
-				satisfied = false
-				break
-			}
-			if satisfied && !buf.status {
-				buffers[i].key = singleRule.getCacheKey(buf.args)
-				cacheKeys = append(cacheKeys, buffers[i].key)
-			}
-		}
+	// 本地策略指针，可避免匹配过程中Global策略被替换 导致不一致；查询出错已记录日志，按未超出限制返回
+	results, _ := CurrentPolicy().multiBrowse(context.Background(), buffers, recordDecision, logHandle)
 
-		if len(cacheKeys) == 0 {
-			continue
-		}
+	var jobResults []JobResult
+	for i, result := range results {
+		jobResults = append(jobResults, JobResult{ID: buffers[i].ID, Result: result})
+		logMsg += " ID" + buffers[i].ID + "~Ret_code:" + strconv.Itoa(int(result.RetCode))
+	}
+	logMsg += " ]"
+	logHandle.Notice(logMsg)
 
-		var multiResult map[string]bool
-		switch singleRule.method {
-		case "direct":
-			if multiResult, err = singleRule.multiDirectBrowse(cacheKeys); err != nil {
-				// err log
-			}
-		case "count":
-			if multiResult, err = singleRule.multiCountBrowse(cacheKeys); err != nil {
-				logHandle.Fatal("[errmsg=" + err.Error() + "]")
-			}
-		case "base":
-			if multiResult, err = singleRule.multiBaseBrowse(cacheKeys); err != nil {
-				// err log
-			}
-		default:
-		}
+	// 返回json结果
+	var retString []byte
+	retString, err = json.Marshal(jobResults)
+	if err != nil {
+		response.SetCode(500)
+		return
+	}
+	response.Puts(string(retString))
 
-		// 统计，记录策略判定数据
-		for _, decision := range multiResult {
-			CounterClient(singleRule.returnCode, decision)
-		}
+	response.SetCode(200)
 
-		for i, buf := range buffers {
-			isOut, OK := multiResult[buf.key]
-			if OK && isOut {
-				buffers[i].status = true
-				buffers[i].decision = int(singleRule.result)
-				buffers[i].retCode = singleRule.returnCode
-			} else if OK && !buf.status {
-				buffers[i].decision = 1
-			}
-		}
+}
+
+// DoMultiUpdate 多重更新访问接口
+// 参数 argsJson 同 /multi/browse；对每个 job 执行与 /rule/update 相同的更新，按 rule 批量写入缓存
+// 说明：同步执行，返回每个 job 的更新结果
+func (s *FrontServer) DoMultiUpdate(request *utility.HttpRequest, response *utility.HttpResponse, logHandle *utility.Logger) {
+	jobs, OK := parseJobs(request, logHandle)
+	if !OK {
+		response.SetCode(400)
+		return
 	}
 
-	var jobResults []JobResult
-	for _, buf := range buffers {
-		var singleResult JobResult
-		singleResult.ID = buf.ID
-		singleResult.Result = localPolicy.retValueTable[buf.decision]
-		singleResult.Result.RetCode = buf.retCode
-		jobResults = append(jobResults, singleResult)
-		logMsg += " ID" + buf.ID + "~Ret_code:" + strconv.Itoa(int(buf.retCode))
+	var logMsg string = ""
+	logMsg += "[ cip=" + request.GetRemoteIP()
+	logMsg += " intf=" + request.PathInfo()
+
+	for _, job := range jobs {
+		logMsg += " ID" + job.ID + "@" + job.Arg
+	}
+	logMsg += " ] ["
+
+	// 整个多重更新使用同一份策略，避免更新过程中Global策略被替换 导致不一致
+	jobResults := CurrentPolicy().multiUpdate(jobs, logHandle)
+
+	for _, result := range jobResults {
+		logMsg += " ID" + result.ID + "~Status:" + strconv.FormatBool(result.Status)
 	}
 	logMsg += " ]"
 	logHandle.Notice(logMsg)
 
 	// 返回json结果
-	var retString []byte
-	retString, err = json.Marshal(jobResults)
+	retString, err := json.Marshal(jobResults)
 	if err != nil {
 		response.SetCode(500)
 		return
@@ -457,7 +444,6 @@ func (s *FrontServer) DoMultiBrowse(request *utility.HttpRequest, response *util
 	response.Puts(string(retString))
 
 	response.SetCode(200)
-
 }
 
 func parseJobArgs(rawArg string) map[string]string {
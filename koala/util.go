@@ -16,6 +16,7 @@ import (
 	"errors"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -27,6 +28,31 @@ func SavePid(pidFile string) {
 	ioutil.WriteFile(pidFile, []byte(pidString), 0777)
 }
 
+// WriteFileAtomic 原子写文件：先写入同目录下的临时文件，再 rename 覆盖目标文件
+func WriteFileAtomic(fileName string, data []byte, perm os.FileMode) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(fileName), filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+	if _, err = tmpFile.Write(data); err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, fileName)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
+
 // IsIPAddress 判断字符串是否是 IP 地址
 func IsIPAddress(s string) bool {
 	// 符合x.x.x.x模式的字符串，即认为是ip地址
@@ -0,0 +1,341 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Rule file formats (bracket & json)
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package rulefmt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+/*
+规则配置文件的两种格式：
+
+1、方括号格式（原有格式）
+   [dicts]
+   global_uid_whitelist : conf/global_uid_whitelist.dat
+   [rules]
+   rule : [count] [act=ask; uid=+;] [time=86400; count=5;] [result=2; return=401]
+   [result]
+   2 : { "Ret_type":2, ... }
+
+2、json 格式（文件扩展名为 .json）
+   {
+     "dicts":   [{"name": "global_uid_whitelist", "file": "conf/global_uid_whitelist.dat"}],
+     "rules":   [{"method": "count", "keys": ["act=ask", "uid=+"], "time": 86400, "count": 5, "result": 2, "return": 401}],
+     "results": [{"id": 2, "value": { "Ret_type":2, ... }}]
+   }
+
+两者语义一致：keys 中每一项即方括号格式 keys 段中以 ; 分隔的一个 key 表达式。
+此处只做语法层面的解析和转换，语义校验由 koala 规则引擎完成；注释不会被转换。
+*/
+
+// File 规则配置文件的结构化表示
+type File struct {
+	Dicts   []Dict   `json:"dicts"`
+	Rules   []Rule   `json:"rules"`
+	Results []Result `json:"results"`
+}
+
+// Dict 词表配置
+type Dict struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+}
+
+// Rule 规则配置；阀值字段为 nil 表示未配置
+type Rule struct {
+	Method string   `json:"method"`
+	Keys   []string `json:"keys"`
+	Base   *int32   `json:"base,omitempty"`
+	Time   *int32   `json:"time,omitempty"`
+	Count  *int32   `json:"count,omitempty"`
+	Erase1 *int32   `json:"erase1,omitempty"`
+	Erase2 *int32   `json:"erase2,omitempty"`
+	Result int32    `json:"result"`
+	Return int32    `json:"return"`
+}
+
+// Result 返回结果配置
+type Result struct {
+	ID    int             `json:"id"`
+	Value json.RawMessage `json:"value"`
+}
+
+// 各种分隔符，trim的时候要除掉他们
+const emptyRunes = " \r\t\v"
+
+// IsJSONFile 按扩展名判断是否为 json 格式的规则文件
+func IsJSONFile(fileName string) bool {
+	return strings.HasSuffix(strings.ToLower(fileName), ".json")
+}
+
+// ParseJSON 解析 json 格式的规则配置
+func ParseJSON(stream []byte) (*File, error) {
+	f := new(File)
+	if err := json.Unmarshal(stream, f); err != nil {
+		return nil, errors.New("rule syntax error: json error, " + err.Error())
+	}
+	for i := range f.Rules {
+		if err := f.Rules[i].check(); err != nil {
+			return nil, errors.New(err.Error() + "  ;AT-RULE-" + strconv.Itoa(i))
+		}
+	}
+	return f, nil
+}
+
+// ParseBracket 解析方括号格式的规则配置
+func ParseBracket(stream []byte) (*File, error) {
+	f := new(File)
+	section := ""
+	for index, line := range strings.Split(string(stream), "\n") {
+		line = strings.Trim(line, emptyRunes)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		switch strings.ToLower(line) {
+		case "[dicts]", "[rules]", "[result]":
+			section = strings.ToLower(line)
+			continue
+		}
+
+		var err error
+		switch section {
+		case "[dicts]":
+			err = f.parseDict(line)
+		case "[rules]":
+			err = f.parseRule(line)
+		case "[result]":
+			err = f.parseResult(line)
+		}
+		if err != nil {
+			return nil, errors.New(err.Error() + "  ;AT-LINE-" + strconv.Itoa(index) + "; " + line)
+		}
+	}
+	return f, nil
+}
+
+// JSON 输出 json 格式的规则配置
+func (f *File) JSON() ([]byte, error) {
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(f); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Bracket 输出方括号格式的规则配置
+func (f *File) Bracket() []byte {
+	var out bytes.Buffer
+	out.WriteString("[dicts]\n")
+	for _, dict := range f.Dicts {
+		out.WriteString(dict.Name + " : " + dict.File + "\n")
+	}
+	out.WriteString("\n[rules]\n")
+	for _, rule := range f.Rules {
+		out.WriteString("rule : " + rule.Bracket() + "\n")
+	}
+	out.WriteString("\n[result]\n")
+	for _, result := range f.Results {
+		// 方括号格式中，每个返回结果必须写在一行内
+		var value bytes.Buffer
+		if err := json.Compact(&value, result.Value); err != nil {
+			value.Write(result.Value)
+		}
+		out.WriteString(strconv.Itoa(result.ID) + " : " + value.String() + "\n")
+	}
+	return out.Bytes()
+}
+
+// Bracket 输出单条规则的方括号格式，如：[count] [act=ask; uid=+;] [time=86400; count=5;] [result=2; return=401;]
+func (r *Rule) Bracket() string {
+	var values []string
+	for _, v := range []struct {
+		name  string
+		value *int32
+	}{{"base", r.Base}, {"time", r.Time}, {"count", r.Count}, {"erase1", r.Erase1}, {"erase2", r.Erase2}} {
+		if v.value != nil {
+			values = append(values, v.name+"="+strconv.Itoa(int(*v.value))+";")
+		}
+	}
+	keys := ""
+	for _, key := range r.Keys {
+		keys += strings.Trim(key, emptyRunes) + "; "
+	}
+	return "[" + r.Method + "] [" + strings.TrimRight(keys, " ") + "] [" + strings.Join(values, " ") + "] [result=" +
+		strconv.Itoa(int(r.Result)) + "; return=" + strconv.Itoa(int(r.Return)) + ";]"
+}
+
+/**
+ * 规则的语法检查；方括号格式中具有特殊含义的字符不允许出现在 key 表达式中
+ */
+func (r *Rule) check() error {
+	if r.Method == "" || strings.ContainsAny(r.Method, "[]; ") {
+		return errors.New("rule syntax error: method error")
+	}
+	if len(r.Keys) == 0 {
+		return errors.New("rule syntax error: keys error, no key")
+	}
+	for _, key := range r.Keys {
+		if strings.Trim(key, emptyRunes) == "" || strings.ContainsAny(key, "[];") {
+			return errors.New("rule syntax error: keys error, " + key)
+		}
+	}
+	if r.Base == nil && r.Time == nil && r.Count == nil && r.Erase1 == nil && r.Erase2 == nil {
+		return errors.New("rule syntax error: value error, no threshold")
+	}
+	return nil
+}
+
+/**
+ * 解析词表配置行；global_qid_whitelist : etc/global_qid_whitelist.dat
+ */
+func (f *File) parseDict(line string) error {
+	parts := strings.SplitN(line, ":", 2)
+	if len(parts) != 2 {
+		return errors.New("dict syntax error: struct error")
+	}
+	f.Dicts = append(f.Dicts, Dict{Name: strings.Trim(parts[0], emptyRunes), File: strings.Trim(parts[1], emptyRunes)})
+	return nil
+}
+
+/**
+ * 解析规则配置行；rule : [method] [keys] [thresholds] [result]
+ */
+func (f *File) parseRule(line string) error {
+	parts := strings.SplitN(line, ":", 2)
+	if len(parts) != 2 || !strings.EqualFold(strings.Trim(parts[0], emptyRunes), "rule") {
+		return errors.New("rule syntax error: struct error")
+	}
+	rule, err := ParseRule(parts[1])
+	if err != nil {
+		return err
+	}
+	f.Rules = append(f.Rules, rule)
+	return nil
+}
+
+// ParseRule 解析单条规则的方括号格式（rule : 之后的部分），如：[count] [act=ask; uid=+;] [time=86400; count=5;] [result=2; return=401]
+// 按方括号成对切分各段，段与段之间的空白不影响解析；koala 规则引擎与格式转换共用
+func ParseRule(text string) (Rule, error) {
+	var sections []string
+	rest := strings.Trim(text, emptyRunes)
+	for rest != "" {
+		if rest[0] != '[' {
+			return Rule{}, errors.New("rule syntax error: section error")
+		}
+		end := strings.IndexByte(rest, ']')
+		if end == -1 {
+			return Rule{}, errors.New("rule syntax error: section error")
+		}
+		sections = append(sections, strings.Trim(rest[1:end], emptyRunes))
+		rest = strings.Trim(rest[end+1:], emptyRunes)
+	}
+	if len(sections) != 4 {
+		return Rule{}, errors.New("rule syntax error: section error")
+	}
+
+	rule := Rule{Method: sections[0]}
+	for _, key := range strings.Split(sections[1], ";") {
+		if key = strings.Trim(key, emptyRunes); key != "" {
+			rule.Keys = append(rule.Keys, key)
+		}
+	}
+	values, err := parseValues(sections[2])
+	if err != nil {
+		return Rule{}, err
+	}
+	for name, value := range values {
+		value := value
+		switch name {
+		case "base":
+			rule.Base = &value
+		case "time":
+			rule.Time = &value
+		case "count":
+			rule.Count = &value
+		case "erase1":
+			rule.Erase1 = &value
+		case "erase2":
+			rule.Erase2 = &value
+		default:
+			return Rule{}, errors.New("rule syntax error: value error")
+		}
+	}
+	rets, err := parseValues(sections[3])
+	if err != nil {
+		return Rule{}, err
+	}
+	for name, value := range rets {
+		switch name {
+		case "result":
+			rule.Result = value
+		case "return":
+			rule.Return = value
+		default:
+			return Rule{}, errors.New("rule syntax error: value error")
+		}
+	}
+	if err = rule.check(); err != nil {
+		return Rule{}, err
+	}
+	return rule, nil
+}
+
+/**
+ * 解析返回结果配置行；1 : { "Ret_type":1, ... }
+ */
+func (f *File) parseResult(line string) error {
+	parts := strings.SplitN(line, ":", 2)
+	if len(parts) != 2 {
+		return errors.New("result syntax error: struct error")
+	}
+	id, err := strconv.Atoi(strings.Trim(parts[0], emptyRunes))
+	if err != nil {
+		return err
+	}
+	var value bytes.Buffer
+	if err = json.Compact(&value, []byte(strings.Trim(parts[1], emptyRunes))); err != nil {
+		return err
+	}
+	f.Results = append(f.Results, Result{ID: id, Value: json.RawMessage(value.Bytes())})
+	return nil
+}
+
+/**
+ * 解析 name=value; 形式的整数值列表
+ */
+func parseValues(section string) (map[string]int32, error) {
+	values := make(map[string]int32)
+	for _, s := range strings.Split(section, ";") {
+		s = strings.Trim(s, emptyRunes)
+		if s == "" {
+			continue
+		}
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("rule syntax error: value error")
+		}
+		value, err := strconv.Atoi(strings.Trim(parts[1], emptyRunes))
+		if err != nil {
+			return nil, errors.New("rule syntax error: value error")
+		}
+		values[strings.Trim(parts[0], emptyRunes)] = int32(value)
+	}
+	return values, nil
+}
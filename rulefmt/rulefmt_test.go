@@ -0,0 +1,159 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine - Rule file format tests
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package rulefmt
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	cases := []struct {
+		name string
+		text string
+		want string // 期望的方括号格式输出；为空时期望出错
+		err  string
+	}{
+		{name: "standard", text: " [count] [act=ask; uid=+;] [time=86400; count=5;] [result=2; return=401]",
+			want: "[count] [act=ask; uid=+;] [time=86400; count=5;] [result=2; return=401;]"},
+		{name: "no spaces", text: "[count][act=ask;uid=+][time=86400;count=5][result=2;return=401]",
+			want: "[count] [act=ask; uid=+;] [time=86400; count=5;] [result=2; return=401;]"},
+		{name: "stray spaces", text: "  [count]   [ act=ask ;uid=+ ]\t[ time = 86400; count=5 ]  [result=2;  return=401;]  \r",
+			want: "[count] [act=ask; uid=+;] [time=86400; count=5;] [result=2; return=401;]"},
+		{name: "all thresholds", text: "[base] [act=ask; ip=+;] [base=50; time=10; count=1; erase1=2; erase2=3;] [result=2; return=203]",
+			want: "[base] [act=ask; ip=+;] [base=50; time=10; count=1; erase1=2; erase2=3;] [result=2; return=203;]"},
+		{name: "dict key", text: "[direct] [qid @ global_qid_whitelist] [time=1; count=0;] [result=1; return=101]",
+			want: "[direct] [qid @ global_qid_whitelist;] [time=1; count=0;] [result=1; return=101;]"},
+		{name: "missing section", text: "[count] [act=ask;] [result=2; return=401]", err: "section error"},
+		{name: "text outside brackets", text: "[count] act=ask; [time=1; count=1;] [result=2; return=401]", err: "section error"},
+		{name: "unclosed bracket", text: "[count] [act=ask; [time=1; count=1;] [result=2; return=401]", err: "section error"},
+		{name: "unknown threshold", text: "[count] [act=ask;] [time=1; limit=1;] [result=2; return=401]", err: "value error"},
+		{name: "bad number", text: "[count] [act=ask;] [time=1; count=x;] [result=2; return=401]", err: "value error"},
+		{name: "no key", text: "[count] [ ; ] [time=1; count=1;] [result=2; return=401]", err: "no key"},
+		{name: "no threshold", text: "[count] [act=ask;] [] [result=2; return=401]", err: "no threshold"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rule, err := ParseRule(c.text)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("want error containing %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := rule.Bracket(); got != c.want {
+				t.Errorf("Bracket() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+/**
+ * 返回结果压缩为一行后再比较：json 格式输出时返回结果带缩进
+ */
+func compactResults(t *testing.T, f *File) *File {
+	compacted := *f
+	compacted.Results = make([]Result, len(f.Results))
+	for i, result := range f.Results {
+		var value bytes.Buffer
+		if err := json.Compact(&value, result.Value); err != nil {
+			t.Fatalf("result %d: %v", result.ID, err)
+		}
+		compacted.Results[i] = Result{ID: result.ID, Value: value.Bytes()}
+	}
+	return &compacted
+}
+
+func TestRoundTrip(t *testing.T) {
+	cases := []struct {
+		name    string
+		bracket string
+	}{
+		{
+			name: "full",
+			bracket: "# 注释不会被转换\r\n[dicts]\r\nglobal_uid_whitelist : conf/global_uid_whitelist.dat\r\n\r\n[rules]\r\n" +
+				"rule : [direct] [uid @ global_uid_whitelist] [time=1; count=0;] [result=1; return=101]\r\n" +
+				"rule:  [count]  [act=ask;uid=+]  [time=86400;count=5]  [result=2;return=401]\r\n" +
+				"rule : [leak] [act=post; ip=+;] [time=10; count=3;] [result=2; return=501]\r\n" +
+				"[result]\r\n" +
+				`1 : { "Ret_type":1, "Str_reason":"Allow" }` + "\r\n" +
+				`2 : { "Ret_type":2, "Err_msg":"limit {limit}, {{ literal", "Str_reason":"Deny" }` + "\r\n",
+		},
+		{name: "rules only", bracket: "[rules]\nrule : [count] [act=ask;] [time=10; count=1;] [result=2; return=1]\n"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f, err := ParseBracket([]byte(c.bracket))
+			if err != nil {
+				t.Fatalf("ParseBracket: %v", err)
+			}
+			stream, err := f.JSON()
+			if err != nil {
+				t.Fatalf("JSON: %v", err)
+			}
+			fromJSON, err := ParseJSON(stream)
+			if err != nil {
+				t.Fatalf("ParseJSON: %v\n%s", err, stream)
+			}
+			if !reflect.DeepEqual(compactResults(t, f), compactResults(t, fromJSON)) {
+				t.Errorf("bracket -> json changed the rules:\n%s", stream)
+			}
+			fromBracket, err := ParseBracket(fromJSON.Bracket())
+			if err != nil {
+				t.Fatalf("ParseBracket(Bracket()): %v", err)
+			}
+			if !reflect.DeepEqual(compactResults(t, f), compactResults(t, fromBracket)) {
+				t.Errorf("json -> bracket changed the rules:\n%s", fromJSON.Bracket())
+			}
+		})
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	cases := []struct {
+		name string
+		json string
+		err  string // 为空时期望解析成功
+	}{
+		{name: "empty", json: `{}`},
+		{name: "valid", json: `{"rules": [{"method": "count", "keys": ["act=ask", "uid=+"], "time": 10, "count": 1, "result": 2, "return": 401}]}`},
+		{name: "not json", json: `[rules]`, err: "json error"},
+		{name: "bracket in key", json: `{"rules": [{"method": "count", "keys": ["act=[ask]"], "time": 10, "result": 2, "return": 1}]}`, err: "keys error"},
+		{name: "semicolon in key", json: `{"rules": [{"method": "count", "keys": ["act=ask;uid=+"], "time": 10, "result": 2, "return": 1}]}`, err: "keys error"},
+		{name: "no threshold", json: `{"rules": [{"method": "count", "keys": ["act=ask"], "result": 2, "return": 1}]}`, err: "AT-RULE-0"},
+		{name: "bad method", json: `{"rules": [{"method": "co unt", "keys": ["act=ask"], "time": 1, "result": 2, "return": 1}]}`, err: "method error"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := ParseJSON([]byte(c.json))
+			if c.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("want error containing %q, got %v", c.err, err)
+			}
+		})
+	}
+}
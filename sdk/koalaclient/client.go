@@ -0,0 +1,372 @@
+/**
+ * Koala Rule Engine SDK
+ *
+ * @package: koalaclient
+ * @desc: koala engine - go sdk code
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+// Package koalaclient koala 频率控制服务的 Go 客户端，功能对应 sdk/koala_sdk.php
+// 连接复用（http keep-alive）、超时、带随机抖动的重试，服务不可用时按配置放行（fail-open）或拒绝（fail-closed）
+package koalaclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 判定结果类型，见 koala_rule.conf [result]
+const (
+	RetDefault = 0 // 没有匹配的规则
+	RetAllow   = 1 // 有匹配的规则，未超出限制
+	RetDeny    = 2 // 超出限制，拒绝
+)
+
+// Quota 限额信息；请求参数 _quota=yes 或命中服务端 quota_namespaces 时返回
+type Quota struct {
+	Limit      int64 `json:"Limit"`
+	Remaining  int64 `json:"Remaining"`
+	ResetAt    int64 `json:"ResetAt"`
+	RetryAfter int64 `json:"RetryAfter"`
+}
+
+// RetValue 判定结果，字段同服务端返回的 json
+type RetValue struct {
+	RetType   int32  `json:"Ret_type"`
+	RetCode   int32  `json:"Ret_code"` // 命中的规则号（rule 的 return 值）
+	ErrNo     int32  `json:"Err_no"`
+	ErrMsg    string `json:"Err_msg"`
+	StrReason string `json:"Str_reason"`
+	NeedVcode int32  `json:"Need_vcode"`
+	VcodeLen  int32  `json:"Vcode_len"`
+	VcodeType int32  `json:"Vcode_type"`
+	Other     string `json:"Other"`
+	Version   int32  `json:"Version"`
+	// 预留 token，Reserve 未超出限制时返回
+	Reservation string `json:"Reservation,omitempty"`
+	*Quota
+}
+
+// Allowed 是否放行：没有匹配的规则，或未超出限制
+func (r *RetValue) Allowed() bool {
+	return r.RetType <= RetAllow
+}
+
+// Options 客户端配置；零值字段使用默认值
+type Options struct {
+	Server       string        // koala 服务地址，host:port 或 http://host:port
+	Timeout      time.Duration // 单次请求超时，默认 500 毫秒
+	Retries      int           // 查询类请求失败后的重试次数，默认 1；小于 0 时不重试
+	RetryBackoff time.Duration // 重试间隔基数，第 n 次重试等待 n 倍基数的 [0.5, 1.5) 随机倍数，默认 20 毫秒
+	MaxIdleConns int           // 保持的空闲连接数，默认 64
+	FailOpen     bool          // 服务不可用时放行（true）或拒绝（false）
+
+	// HTTPClient 使用自定义的 http.Client；设置后忽略 Timeout、MaxIdleConns
+	HTTPClient *http.Client
+}
+
+// Client koala 服务客户端，可并发使用
+type Client struct {
+	server   string
+	client   *http.Client
+	retries  int
+	backoff  time.Duration
+	failOpen bool
+}
+
+// JobResult 多重查询中单个任务的结果
+type JobResult struct {
+	ID     string   `json:"ID"`
+	Result RetValue `json:"Result"`
+}
+
+// UpdateRule 同步更新中单条规则的结果
+type UpdateRule struct {
+	Return    int32  `json:"return"`
+	Method    string `json:"method"`
+	OK        bool   `json:"ok"`
+	Duplicate bool   `json:"duplicate,omitempty"` // 同一 _reqid 已经更新过，本次跳过
+	Error     string `json:"error,omitempty"`
+}
+
+// ErrUnavailable 服务不可用（连接失败、超时、5xx）；Check 等方法返回的错误均包装了原因
+var ErrUnavailable = errors.New("koala unavailable")
+
+// New 创建客户端
+func New(options Options) *Client {
+	server := strings.TrimRight(options.Server, "/")
+	if !strings.HasPrefix(server, "http://") && !strings.HasPrefix(server, "https://") {
+		server = "http://" + server
+	}
+	c := &Client{server: server, client: options.HTTPClient, retries: options.Retries, backoff: options.RetryBackoff, failOpen: options.FailOpen}
+	if c.client == nil {
+		timeout := options.Timeout
+		if timeout <= 0 {
+			timeout = 500 * time.Millisecond
+		}
+		maxIdle := options.MaxIdleConns
+		if maxIdle <= 0 {
+			maxIdle = 64
+		}
+		c.client = &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				DialContext:         (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext,
+				MaxIdleConns:        maxIdle,
+				MaxIdleConnsPerHost: maxIdle,
+				IdleConnTimeout:     50 * time.Second,
+			},
+		}
+	}
+	if c.retries == 0 {
+		c.retries = 1
+	}
+	if c.backoff <= 0 {
+		c.backoff = 20 * time.Millisecond
+	}
+	return c
+}
+
+// Check 查询，/rule/browse；writeThrough 为 true 时未超出限制即计数（_writeThrough=yes）
+// writeThrough 时与 Write 相同，带 _reqid 才重试；服务不可用时返回错误，同时按 FailOpen 给出放行或拒绝的结果
+func (c *Client) Check(ctx context.Context, params map[string]string, writeThrough bool) (*RetValue, error) {
+	if writeThrough {
+		params = withParam(params, "_writeThrough", "yes")
+	}
+	ret := new(RetValue)
+	retry := !writeThrough || params["_reqid"] != ""
+	if err := c.call(ctx, "/rule/browse", params, retry, ret); err != nil {
+		return c.fallback(), err
+	}
+	return ret, nil
+}
+
+// CheckComplete 完全查询，/rule/browse_complete；返回所有命中的规则的结果
+func (c *Client) CheckComplete(ctx context.Context, params map[string]string) ([]RetValue, error) {
+	var rets []RetValue
+	if err := c.call(ctx, "/rule/browse_complete", params, true, &rets); err != nil {
+		return []RetValue{*c.fallback()}, err
+	}
+	return rets, nil
+}
+
+// MultiCheck 多重查询，/multi/browse；结果与 jobs 一一对应
+func (c *Client) MultiCheck(ctx context.Context, jobs []map[string]string) ([]RetValue, error) {
+	body := make([]map[string]string, len(jobs))
+	for i, job := range jobs {
+		body[i] = withParam(job, "ID", strconv.Itoa(i))
+	}
+	var results []JobResult
+	if err := c.call(ctx, "/multi/browse", body, true, &results); err != nil {
+		rets := make([]RetValue, len(jobs))
+		for i := range rets {
+			rets[i] = *c.fallback()
+		}
+		return rets, err
+	}
+	rets := make([]RetValue, len(jobs))
+	for _, result := range results {
+		if i, err := strconv.Atoi(result.ID); err == nil && i >= 0 && i < len(rets) {
+			rets[i] = result.Result
+		}
+	}
+	return rets, nil
+}
+
+// Reserve 预留查询，/rule/browse?_reserve=yes；未超出限制时占用额度，结果的 Reservation 为预留 token
+// 动作完成后调用 Commit 保留占用，失败时调用 Cancel 退还；超时未处理的预留由服务端自动退还
+// 占用额度不是幂等操作，请求失败时不重试；服务不可用时按 FailOpen 给出结果，此时 Reservation 为空
+func (c *Client) Reserve(ctx context.Context, params map[string]string) (*RetValue, error) {
+	ret := new(RetValue)
+	if err := c.call(ctx, "/rule/browse", withParam(params, "_reserve", "yes"), false, ret); err != nil {
+		return c.fallback(), err
+	}
+	return ret, nil
+}
+
+// Commit 确认预留，/rule/commit；reservation 为空时（没有预留）直接返回
+func (c *Client) Commit(ctx context.Context, reservation string) error {
+	return c.settle(ctx, "/rule/commit", reservation)
+}
+
+// Cancel 取消预留并退还额度，/rule/cancel；reservation 为空时（没有预留）直接返回
+func (c *Client) Cancel(ctx context.Context, reservation string) error {
+	return c.settle(ctx, "/rule/cancel", reservation)
+}
+
+/**
+ * commit、cancel 的公共部分；预留已处理或已超时退还时，服务端返回 404
+ */
+func (c *Client) settle(ctx context.Context, path string, reservation string) error {
+	if reservation == "" {
+		return nil
+	}
+	var ret struct {
+		ErrNo  int    `json:"errno"`
+		ErrMsg string `json:"errmsg"`
+	}
+	err := c.call(ctx, path, map[string]string{"reservation": reservation}, true, &ret)
+	if err != nil && ret.ErrNo != 0 {
+		return errors.New("koala: " + ret.ErrMsg)
+	}
+	return err
+}
+
+// Write 更新计数，/rule/update；服务端异步执行，立即返回
+// 更新不是幂等操作，请求失败时不重试；params 带 _reqid（见 WithReqID）时为幂等更新，按配置重试
+func (c *Client) Write(ctx context.Context, params map[string]string) error {
+	var ret struct {
+		ErrNo  int    `json:"err_no"`
+		ErrMsg string `json:"err_msg"`
+	}
+	if err := c.call(ctx, "/rule/update", params, params["_reqid"] != "", &ret); err != nil {
+		return err
+	}
+	if ret.ErrNo != 0 {
+		return errors.New("koala: " + ret.ErrMsg)
+	}
+	return nil
+}
+
+// Update 同步更新计数，/rule/update?_sync=yes；返回每条规则的结果，任一规则更新失败时同时返回错误
+// 与 Write 相同，带 _reqid 时才重试
+func (c *Client) Update(ctx context.Context, params map[string]string) ([]UpdateRule, error) {
+	var ret struct {
+		ErrNo  int          `json:"err_no"`
+		ErrMsg string       `json:"err_msg"`
+		Rules  []UpdateRule `json:"rules"`
+	}
+	err := c.call(ctx, "/rule/update", withParam(params, "_sync", "yes"), params["_reqid"] != "", &ret)
+	if ret.Rules != nil && ret.ErrNo != 0 {
+		return ret.Rules, errors.New("koala: " + ret.ErrMsg)
+	}
+	return ret.Rules, err
+}
+
+// MonitorAlive 检查 koala 服务及其与 redis 的连通性，/monitor/alive
+func (c *Client) MonitorAlive(ctx context.Context) error {
+	var ret struct {
+		ErrNo  int    `json:"errno"`
+		ErrMsg string `json:"errmsg"`
+	}
+	return c.call(ctx, "/monitor/alive", map[string]string{}, true, &ret)
+}
+
+/**
+ * 服务不可用时的结果：FailOpen 为放行，否则为拒绝
+ */
+func (c *Client) fallback() *RetValue {
+	if c.failOpen {
+		return &RetValue{RetType: RetAllow, StrReason: "Allow"}
+	}
+	return &RetValue{RetType: RetDeny, StrReason: "Deny"}
+}
+
+/**
+ * 以 json 请求体 POST 调用接口，解析返回的 json 到 ret
+ * retry 为 true 时，连接失败、超时、5xx 按配置重试；4xx 不重试
+ * 5xx 时仍会尝试解析返回内容（如同步更新的结果）
+ */
+func (c *Client) call(ctx context.Context, path string, params interface{}, retry bool, ret interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	attempts := 1
+	if retry && c.retries > 0 {
+		attempts += c.retries
+	}
+	for n := 0; ; n++ {
+		var status int
+		status, err = c.post(ctx, path, body, ret)
+		if err == nil {
+			return nil
+		}
+		if status >= 400 && status < 500 || n+1 >= attempts || ctx.Err() != nil {
+			return err
+		}
+		// 带抖动的退避，避免服务恢复时的集中重试
+		wait := time.Duration(float64(c.backoff) * float64(n+1) * (0.5 + rand.Float64()))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (c *Client) post(ctx context.Context, path string, body []byte, ret interface{}) (int, error) {
+	request, err := http.NewRequest("POST", c.server+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+	response, err := c.client.Do(request)
+	if err != nil {
+		return 0, wrapUnavailable(err.Error())
+	}
+	defer response.Body.Close()
+	stream, err := ioutil.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return response.StatusCode, wrapUnavailable(err.Error())
+	}
+	decodeErr := json.Unmarshal(stream, ret)
+	switch {
+	case response.StatusCode >= 500:
+		return response.StatusCode, wrapUnavailable(response.Status)
+	case response.StatusCode != 200:
+		return response.StatusCode, errors.New("koala: " + path + " " + response.Status)
+	case decodeErr != nil:
+		return response.StatusCode, errors.New("koala: bad response, " + decodeErr.Error())
+	}
+	return response.StatusCode, nil
+}
+
+type unavailableError struct {
+	reason string
+}
+
+func (e *unavailableError) Error() string {
+	return ErrUnavailable.Error() + ": " + e.reason
+}
+
+// Is 支持 errors.Is(err, ErrUnavailable)
+func (e *unavailableError) Is(target error) bool {
+	return target == ErrUnavailable
+}
+
+func wrapUnavailable(reason string) error {
+	return &unavailableError{reason: reason}
+}
+
+/**
+ * 复制参数并设置一个值，不修改调用方的 map
+ */
+func withParam(params map[string]string, key, value string) map[string]string {
+	copied := make(map[string]string, len(params)+1)
+	for k, v := range params {
+		copied[k] = v
+	}
+	copied[key] = value
+	return copied
+}
+
+// WithReqID 返回带 _reqid 的参数副本，用于幂等更新；同一次业务操作的重试应使用同一个 reqID
+func WithReqID(params map[string]string, reqID string) map[string]string {
+	return withParam(params, "_reqid", reqID)
+}
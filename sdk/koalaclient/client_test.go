@@ -0,0 +1,212 @@
+/**
+ * Koala Rule Engine SDK
+ *
+ * @package: koalaclient
+ * @desc: koala engine - go sdk tests
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koalaclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCall 测试服务收到的一次请求
+type testCall struct {
+	Path   string
+	Params map[string]string
+}
+
+// testServer 记录收到的请求，按 reply 依次返回状态码和内容
+type testServer struct {
+	*httptest.Server
+	mu    sync.Mutex
+	calls []testCall
+	reply func(n int, call testCall) (int, interface{})
+}
+
+/**
+ * 启动测试服务；reply 的 n 为请求序号（从 0 开始）
+ */
+func newTestServer(t *testing.T, reply func(n int, call testCall) (int, interface{})) *testServer {
+	s := &testServer{reply: reply}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := testCall{Path: r.URL.Path}
+		if err := json.NewDecoder(r.Body).Decode(&call.Params); err != nil {
+			t.Errorf("%s: bad request body, %v", r.URL.Path, err)
+		}
+		s.mu.Lock()
+		n := len(s.calls)
+		s.calls = append(s.calls, call)
+		s.mu.Unlock()
+
+		code, body := s.reply(n, call)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(body)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testServer) Calls() []testCall {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]testCall{}, s.calls...)
+}
+
+/**
+ * 测试用客户端：重试 1 次，退避 1 毫秒
+ */
+func newTestClient(server string, failOpen bool) *Client {
+	return New(Options{Server: server, Retries: 1, RetryBackoff: time.Millisecond, FailOpen: failOpen})
+}
+
+func TestCheckRetry(t *testing.T) {
+	cases := []struct {
+		name         string
+		writeThrough bool
+		reqID        string
+		codes        []int // 依次返回的状态码，超出部分返回 200
+		wantCalls    int
+		wantErr      bool
+		unavailable  bool
+	}{
+		{name: "retry after 503", codes: []int{503}, wantCalls: 2},
+		{name: "give up after retries", codes: []int{503, 502}, wantCalls: 2, wantErr: true, unavailable: true},
+		{name: "no retry on 4xx", codes: []int{400}, wantCalls: 1, wantErr: true},
+		{name: "write through not retried", writeThrough: true, codes: []int{503}, wantCalls: 1, wantErr: true, unavailable: true},
+		{name: "write through with reqid retried", writeThrough: true, reqID: "order-1", codes: []int{503}, wantCalls: 2},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := newTestServer(t, func(n int, call testCall) (int, interface{}) {
+				if n < len(c.codes) {
+					return c.codes[n], map[string]string{}
+				}
+				return 200, RetValue{RetType: RetAllow, RetCode: 201, StrReason: "Allow"}
+			})
+			params := map[string]string{"act": "ask", "uid": "10001"}
+			if c.reqID != "" {
+				params = WithReqID(params, c.reqID)
+			}
+			ret, err := newTestClient(server.URL, false).Check(context.Background(), params, c.writeThrough)
+
+			calls := server.Calls()
+			if len(calls) != c.wantCalls {
+				t.Fatalf("want %d calls, got %d", c.wantCalls, len(calls))
+			}
+			if c.writeThrough && calls[0].Params["_writeThrough"] != "yes" {
+				t.Errorf("want _writeThrough=yes, got %v", calls[0].Params)
+			}
+			if (err != nil) != c.wantErr {
+				t.Fatalf("want error %v, got %v", c.wantErr, err)
+			}
+			if errors.Is(err, ErrUnavailable) != c.unavailable {
+				t.Errorf("want unavailable %v, got %v", c.unavailable, err)
+			}
+			if err == nil && ret.RetCode != 201 {
+				t.Errorf("want result of the successful call, got %+v", ret)
+			}
+		})
+	}
+}
+
+func TestFailOpen(t *testing.T) {
+	server := newTestServer(t, func(n int, call testCall) (int, interface{}) {
+		return 200, RetValue{}
+	})
+	server.Close()
+
+	for _, failOpen := range []bool{true, false} {
+		client := newTestClient(server.URL, failOpen)
+		ret, err := client.Check(context.Background(), map[string]string{"act": "ask"}, false)
+		if !errors.Is(err, ErrUnavailable) {
+			t.Fatalf("failOpen=%v: want ErrUnavailable, got %v", failOpen, err)
+		}
+		if ret.Allowed() != failOpen {
+			t.Errorf("failOpen=%v: Allowed() = %v", failOpen, ret.Allowed())
+		}
+
+		rets, err := client.MultiCheck(context.Background(), []map[string]string{{"act": "ask"}, {"act": "post"}})
+		if err == nil || len(rets) != 2 || rets[0].Allowed() != failOpen || rets[1].Allowed() != failOpen {
+			t.Errorf("failOpen=%v: MultiCheck want fallback results, got %+v, %v", failOpen, rets, err)
+		}
+	}
+}
+
+func TestReservation(t *testing.T) {
+	const token = "0123456789abcdef0123456789abcdef"
+	settled := map[string]bool{}
+	server := newTestServer(t, func(n int, call testCall) (int, interface{}) {
+		switch call.Path {
+		case "/rule/browse":
+			if call.Params["_reserve"] != "yes" {
+				return 400, map[string]string{}
+			}
+			if n > 0 {
+				// 第二次预留：超出限制
+				return 503, map[string]string{}
+			}
+			return 200, RetValue{RetType: RetAllow, RetCode: 201, Reservation: token}
+		case "/rule/commit", "/rule/cancel":
+			if settled[call.Params["reservation"]] {
+				return 404, map[string]interface{}{"errno": -1, "errmsg": "reservation not found or expired"}
+			}
+			settled[call.Params["reservation"]] = true
+			return 200, map[string]interface{}{"errno": 0, "errmsg": "OK"}
+		}
+		return 404, map[string]string{}
+	})
+	client := newTestClient(server.URL, true)
+	ctx := context.Background()
+
+	ret, err := client.Reserve(ctx, map[string]string{"act": "ask"})
+	if err != nil || ret.Reservation != token {
+		t.Fatalf("Reserve: want reservation %s, got %+v, %v", token, ret, err)
+	}
+	if err := client.Commit(ctx, ret.Reservation); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	// 已经 commit 的预留：服务端返回 404，不重试
+	if err := client.Cancel(ctx, ret.Reservation); err == nil || err.Error() != "koala: reservation not found or expired" {
+		t.Errorf("Cancel after Commit: want not found error, got %v", err)
+	}
+	// 没有预留时不请求服务端
+	if err := client.Cancel(ctx, ""); err != nil {
+		t.Errorf("Cancel empty: %v", err)
+	}
+
+	// 预留失败时不重试，按 FailOpen 放行，且不带 token
+	ret, err = client.Reserve(ctx, map[string]string{"act": "ask"})
+	if !errors.Is(err, ErrUnavailable) || !ret.Allowed() || ret.Reservation != "" {
+		t.Errorf("Reserve unavailable: want fail-open result, got %+v, %v", ret, err)
+	}
+
+	paths := []string{}
+	for _, call := range server.Calls() {
+		paths = append(paths, call.Path)
+	}
+	want := []string{"/rule/browse", "/rule/commit", "/rule/cancel", "/rule/browse"}
+	if len(paths) != len(want) {
+		t.Fatalf("want calls %v, got %v", want, paths)
+	}
+	for i := range want {
+		if paths[i] != want[i] {
+			t.Fatalf("want calls %v, got %v", want, paths)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+/**
+ * Koala Rule Engine SDK
+ *
+ * @package: koalaclient
+ * @desc: koala engine - go sdk net/http middleware
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koalaclient
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MiddlewareOptions 中间件配置
+type MiddlewareOptions struct {
+	// Params 从请求中提取用于匹配规则的参数；为空时使用 RequestParams（加上 AllowParams）
+	Params func(r *http.Request) map[string]string
+	// AllowParams 允许客户端通过 query string 传入的 _ 开头参数（如 _reqid）；
+	// 未列出的 _ 开头参数（_writeThrough、_reserve、_quota、_token 等控制参数）一律丢弃
+	AllowParams []string
+	// OnDeny 拒绝时的处理；为空时返回 429，带 Retry-After（有限额信息时）和判定结果的 json
+	OnDeny func(w http.ResponseWriter, r *http.Request, ret *RetValue)
+	// OnError 服务不可用且未配置 FailOpen 时的处理；为空时返回 503
+	OnError func(w http.ResponseWriter, r *http.Request, err error)
+	// Update 放行的请求处理完成后计数（Write），对应 check + write 的调用方式
+	Update bool
+	// Quota 查询时附带限额信息（_quota=yes），拒绝时据此设置 Retry-After
+	Quota bool
+}
+
+// Middleware net/http 中间件：每个请求先查询，未超出限制时交给 next 处理，否则按 OnDeny 拒绝
+func (c *Client) Middleware(options MiddlewareOptions) func(http.Handler) http.Handler {
+	extract := options.Params
+	if extract == nil {
+		allow := options.AllowParams
+		extract = func(r *http.Request) map[string]string {
+			return requestParams(r, allow)
+		}
+	}
+	onDeny := options.OnDeny
+	if onDeny == nil {
+		onDeny = denyResponse
+	}
+	onError := options.OnError
+	if onError == nil {
+		onError = func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			params := extract(r)
+			checkParams := params
+			if options.Quota {
+				checkParams = withParam(params, "_quota", "yes")
+			}
+			ret, err := c.Check(r.Context(), checkParams, false)
+			if err != nil && !c.failOpen {
+				onError(w, r, err)
+				return
+			}
+			if !ret.Allowed() {
+				onDeny(w, r, ret)
+				return
+			}
+			next.ServeHTTP(w, r)
+			if options.Update && err == nil {
+				// 请求已处理完成，计数失败不影响响应
+				c.Write(r.Context(), params)
+			}
+		})
+	}
+}
+
+// RequestParams 默认的参数提取：query string 中的参数（同名取第一个），act 为请求路径，ip 为客户端地址
+// act、ip 总是由服务端得出，请求中同名参数会被覆盖；_ 开头的控制参数一律丢弃
+func RequestParams(r *http.Request) map[string]string {
+	return requestParams(r, nil)
+}
+
+/**
+ * 提取参数；allow 中列出的 _ 开头参数保留
+ */
+func requestParams(r *http.Request, allow []string) map[string]string {
+	query := r.URL.Query()
+	params := make(map[string]string, len(query)+2)
+	for k, v := range query {
+		if len(v) == 0 || (strings.HasPrefix(k, "_") && !inStrings(allow, k)) {
+			continue
+		}
+		params[k] = v[0]
+	}
+	params["act"] = r.URL.Path
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		params["ip"] = host
+	} else {
+		params["ip"] = r.RemoteAddr
+	}
+	return params
+}
+
+func inStrings(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func denyResponse(w http.ResponseWriter, r *http.Request, ret *RetValue) {
+	if ret.Quota != nil && ret.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(ret.RetryAfter, 10))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(ret)
+}
@@ -0,0 +1,84 @@
+/**
+ * Koala Rule Engine SDK
+ *
+ * @package: koalaclient
+ * @desc: koala engine - go sdk net/http middleware tests
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package koalaclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	cases := []struct {
+		name      string
+		target    string
+		allow     []string
+		deny      bool
+		wantCode  int
+		wantCheck map[string]string // 查询时的参数
+	}{
+		{
+			name: "plain", target: "/ask?uid=10001", wantCode: 200,
+			wantCheck: map[string]string{"act": "/ask", "uid": "10001", "ip": "192.0.2.1"},
+		},
+		{
+			name: "client act and ip ignored", target: "/ask?uid=10001&act=free&ip=10.0.0.1", wantCode: 200,
+			wantCheck: map[string]string{"act": "/ask", "uid": "10001", "ip": "192.0.2.1"},
+		},
+		{
+			name: "control params dropped", target: "/ask?uid=10001&_writeThrough=yes&_reserve=yes&_token=x&_reqid=r1", wantCode: 200,
+			wantCheck: map[string]string{"act": "/ask", "uid": "10001", "ip": "192.0.2.1"},
+		},
+		{
+			name: "allowed control param kept", target: "/ask?uid=10001&_reqid=r1&_sync=yes", allow: []string{"_reqid"}, wantCode: 200,
+			wantCheck: map[string]string{"act": "/ask", "uid": "10001", "ip": "192.0.2.1", "_reqid": "r1"},
+		},
+		{
+			name: "denied", target: "/ask?uid=10001", deny: true, wantCode: http.StatusTooManyRequests,
+			wantCheck: map[string]string{"act": "/ask", "uid": "10001", "ip": "192.0.2.1"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := newTestServer(t, func(n int, call testCall) (int, interface{}) {
+				if c.deny {
+					return 200, RetValue{RetType: RetDeny, RetCode: 401, StrReason: "Deny"}
+				}
+				return 200, RetValue{RetType: RetAllow, StrReason: "Allow"}
+			})
+			served := false
+			handler := newTestClient(server.URL, false).Middleware(MiddlewareOptions{AllowParams: c.allow})(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					served = true
+				}))
+
+			request := httptest.NewRequest("GET", c.target, nil)
+			request.RemoteAddr = "192.0.2.1:40000"
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			if recorder.Code != c.wantCode || served != (c.wantCode == 200) {
+				t.Errorf("want code %d, got %d (served %v)", c.wantCode, recorder.Code, served)
+			}
+			calls := server.Calls()
+			if len(calls) != 1 || calls[0].Path != "/rule/browse" {
+				t.Fatalf("want one /rule/browse call, got %+v", calls)
+			}
+			if !reflect.DeepEqual(calls[0].Params, c.wantCheck) {
+				t.Errorf("check params: want %v, got %v", c.wantCheck, calls[0].Params)
+			}
+		})
+	}
+}
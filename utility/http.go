@@ -14,6 +14,7 @@ package utility
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"net/url"
 	"strconv"
@@ -172,6 +173,16 @@ func (c *HttpConnection) WriteResponse(response *HttpResponse, timeout time.Dura
 	return c.writeStream(response.Stream())
 }
 
+// WriteHeadResponse .
+// 应答 HEAD 请求：只写状态行和头部，Content-Length 仍为正文长度
+func (c *HttpConnection) WriteHeadResponse(response *HttpResponse, timeout time.Duration) error {
+	if err := c.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	stream := response.Stream()
+	return c.writeStream(stream[0 : bytes.Index(stream, []byte(httpHeadBodySeparator))+httpHeadBodySeparatorLen])
+}
+
 // readMessageTo .
 func (c *HttpConnection) readMessageTo(httpMessage HttpMessage, stream *[]byte) (HttpMessage, error) {
 	for *stream == nil || bytes.Index(*stream, []byte(httpHeadBodySeparator)) == -1 {
@@ -273,6 +284,7 @@ type HttpRequest struct {
 	posts      map[string]string
 	cookies    map[string]string
 	vars       map[string]interface{}
+	postList   []map[string]string // application/json 数组请求体，每个元素为一个平铺对象
 }
 
 // NewHttpRequest .
@@ -316,6 +328,8 @@ func (r *HttpRequest) SetUri(uri string) {
 	r.uri = uri
 	if markPos := strings.Index(r.uri, "?"); markPos != -1 {
 		r.pathInfo = r.uri[:markPos]
+	} else {
+		r.pathInfo = r.uri
 	}
 }
 
@@ -422,6 +436,26 @@ func (r *HttpRequest) Pint(key string) int {
 	return i
 }
 
+// PostList .
+// application/json 数组请求体（批量调用），每个元素为一个平铺对象；其他请求为 nil
+func (r *HttpRequest) PostList() []map[string]string {
+	return r.postList
+}
+
+// Params .
+// 统一参数：query string 与请求体（表单或 application/json 对象）合并，同名时请求体优先（同 Rstr）
+// 每次调用返回新的 map，调用方可自由修改
+func (r *HttpRequest) Params() map[string]string {
+	params := make(map[string]string, len(r.gets)+len(r.posts))
+	for key, value := range r.gets {
+		params[key] = value
+	}
+	for key, value := range r.posts {
+		params[key] = value
+	}
+	return params
+}
+
 // Rint .
 func (r *HttpRequest) Rint(key string) int {
 	if value := r.Pint(key); value != 0 {
@@ -443,6 +477,21 @@ func (r *HttpRequest) SetPosts(posts map[string]string) {
 	r.posts = posts
 }
 
+// SetPostList .
+func (r *HttpRequest) SetPostList(postList []map[string]string) {
+	r.postList = postList
+}
+
+// SetJSONBody 按 application/json 请求体解析参数，规则同 http 请求
+func (r *HttpRequest) SetJSONBody(bodyStream []byte) error {
+	return r.parseJSONBodyStream(bodyStream)
+}
+
+// SetRemoteAddr .
+func (r *HttpRequest) SetRemoteAddr(remoteAddr string) {
+	r.remoteAddr = remoteAddr
+}
+
 // Cookies .
 func (r *HttpRequest) Cookies() map[string]string {
 	return r.cookies
@@ -478,15 +527,26 @@ func (r *HttpRequest) Cint(key string) int {
 }
 
 // IsKeepAlive .
+// HTTP/1.1 默认保持连接，Connection: close 时关闭；HTTP/1.0 需显式 Connection: keep-alive
 func (r *HttpRequest) IsKeepAlive() bool {
-	return r.version == "HTTP/1.1" && r.Header("Connection") != "close"
+	connection := strings.ToLower(r.Header("Connection"))
+	if r.version == "HTTP/1.1" {
+		return !strings.Contains(connection, "close")
+	}
+	return strings.Contains(connection, "keep-alive")
 }
 
 // Header .
+// 头名称不区分大小写
 func (r *HttpRequest) Header(key string) string {
 	if value, ok := r.headers[key]; ok {
 		return value
 	}
+	for k, value := range r.headers {
+		if strings.EqualFold(k, key) {
+			return value
+		}
+	}
 	return ""
 }
 
@@ -540,6 +600,7 @@ func (r *HttpRequest) parseHairStream(hairStream []byte) error {
 		return errors.New("bad http request")
 	}
 	r.method, r.uri, r.version = string(parts[0]), string(parts[1]), string(parts[2])
+	r.uri = stripAbsoluteUri(r.uri)
 	r.pathInfo = r.uri
 	if markPos := strings.Index(r.uri, "?"); markPos != -1 {
 		r.pathInfo = r.uri[0:markPos]
@@ -566,7 +627,29 @@ func (r *HttpRequest) parseHairStream(hairStream []byte) error {
 	return nil
 }
 
+/**
+ * 绝对 URI 形式的请求目标（http://host:port/path?query，代理和部分健康检查会这样发）只保留 path 及之后的部分
+ */
+func stripAbsoluteUri(uri string) string {
+	for _, scheme := range []string{"http://", "https://"} {
+		if len(uri) >= len(scheme) && strings.EqualFold(uri[0:len(scheme)], scheme) {
+			rest := uri[len(scheme):]
+			if pos := strings.IndexAny(rest, "/?"); pos != -1 {
+				if rest[pos] == '?' {
+					return "/" + rest[pos:]
+				}
+				return rest[pos:]
+			}
+			return "/"
+		}
+	}
+	return uri
+}
+
 func (r *HttpRequest) parseBodyStream(bodyStream []byte) error {
+	if r.isJSONBody() {
+		return r.parseJSONBodyStream(bodyStream)
+	}
 	kvStrings := strings.Split(string(bodyStream), "&")
 	for _, kvString := range kvStrings {
 		parts := strings.SplitN(kvString, "=", 2)
@@ -586,6 +669,72 @@ func (r *HttpRequest) parseBodyStream(bodyStream []byte) error {
 	return nil
 }
 
+/**
+ * Content-Type 是否为 application/json；头名称不区分大小写
+ */
+func (r *HttpRequest) isJSONBody() bool {
+	for key, value := range r.headers {
+		if strings.EqualFold(key, "Content-Type") {
+			return strings.HasPrefix(strings.ToLower(strings.Trim(value, " ")), "application/json")
+		}
+	}
+	return false
+}
+
+/**
+ * 解析 json 请求体：平铺对象存入 posts；对象数组存入 postList
+ * 值统一转为字符串：数字、布尔按字面值，null 为空串，嵌套的对象、数组保留 json 原文
+ */
+func (r *HttpRequest) parseJSONBodyStream(bodyStream []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(bodyStream))
+	decoder.UseNumber()
+	var body interface{}
+	if err := decoder.Decode(&body); err != nil {
+		return errors.New("bad http request")
+	}
+	switch body := body.(type) {
+	case map[string]interface{}:
+		for key, value := range body {
+			r.posts[key] = jsonValueString(value)
+		}
+	case []interface{}:
+		r.postList = make([]map[string]string, 0, len(body))
+		for _, item := range body {
+			object, ok := item.(map[string]interface{})
+			if !ok {
+				return errors.New("bad http request")
+			}
+			one := make(map[string]string, len(object))
+			for key, value := range object {
+				one[key] = jsonValueString(value)
+			}
+			r.postList = append(r.postList, one)
+		}
+	default:
+		return errors.New("bad http request")
+	}
+	return nil
+}
+
+func jsonValueString(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		stream, err := json.Marshal(value)
+		if err != nil {
+			return ""
+		}
+		return string(stream)
+	}
+}
+
 // HttpResponse .
 type HttpResponse struct {
 	version    string
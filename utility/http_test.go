@@ -0,0 +1,188 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine http request parse tests
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package utility
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHttpJSONBody(t *testing.T) {
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+		posts       map[string]string
+		postList    []map[string]string
+		bad         bool // 期望解析失败
+	}{
+		{
+			name: "object", contentType: "application/json",
+			body:  `{"act":"ask","uid":10001,"rate":1.50,"vip":true,"ref":null,"tags":["a","b"],"ext":{"k":"v"}}`,
+			posts: map[string]string{"act": "ask", "uid": "10001", "rate": "1.50", "vip": "true", "ref": "", "tags": `["a","b"]`, "ext": `{"k":"v"}`},
+		},
+		{
+			name: "large number kept", contentType: "application/json",
+			body:  `{"uid":12345678901234567890}`,
+			posts: map[string]string{"uid": "12345678901234567890"},
+		},
+		{
+			name: "content type with charset", contentType: " Application/JSON; charset=utf-8",
+			body:  `{"act":"ask"}`,
+			posts: map[string]string{"act": "ask"},
+		},
+		{
+			name: "array of objects", contentType: "application/json",
+			body:     `[{"act":"ask","uid":1},{"act":"post"}]`,
+			posts:    map[string]string{},
+			postList: []map[string]string{{"act": "ask", "uid": "1"}, {"act": "post"}},
+		},
+		{name: "array with scalar", contentType: "application/json", body: `[{"act":"ask"},1]`, bad: true},
+		{name: "scalar body", contentType: "application/json", body: `"ask"`, bad: true},
+		{name: "malformed", contentType: "application/json", body: `{"act":"ask"`, bad: true},
+		{
+			name: "form", contentType: "application/x-www-form-urlencoded",
+			body:  "act=ask&uid=a%20b",
+			posts: map[string]string{"act": "ask", "uid": "a b"},
+		},
+		{name: "form without content type", body: `{"act":"ask"}`, bad: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			request := NewHttpRequest()
+			if c.contentType != "" {
+				request.SetHeader("content-type", c.contentType)
+			}
+			err := request.parseBodyStream([]byte(c.body))
+			if c.bad {
+				if err == nil {
+					t.Fatalf("want error, got posts %v", request.Posts())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(request.Posts(), c.posts) {
+				t.Errorf("posts: want %v, got %v", c.posts, request.Posts())
+			}
+			if !reflect.DeepEqual(request.PostList(), c.postList) {
+				t.Errorf("post list: want %v, got %v", c.postList, request.PostList())
+			}
+		})
+	}
+}
+
+func TestHttpKeepAlive(t *testing.T) {
+	cases := []struct {
+		name       string
+		version    string
+		connection string
+		want       bool
+	}{
+		{name: "http/1.1 default", version: "HTTP/1.1", want: true},
+		{name: "http/1.1 close", version: "HTTP/1.1", connection: "Close", want: false},
+		{name: "http/1.1 close in list", version: "HTTP/1.1", connection: "TE, close", want: false},
+		{name: "http/1.0 default", version: "HTTP/1.0", want: false},
+		{name: "http/1.0 keep-alive", version: "HTTP/1.0", connection: "Keep-Alive", want: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			request := NewHttpRequest()
+			request.SetVersion(c.version)
+			if c.connection != "" {
+				request.SetHeader("connection", c.connection)
+			}
+			if got := request.IsKeepAlive(); got != c.want {
+				t.Errorf("IsKeepAlive() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestHttpPipelinedRequests(t *testing.T) {
+	body := "uid=10001&act=ask"
+	stream := "GET /rule/browse?act=ask HTTP/1.1\r\nHost: koala\r\n\r\n" +
+		"POST /rule/update HTTP/1.1\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body +
+		"GET /monitor/alive HTTP/1.1\r\nConnection: close\r\n\r\n"
+	want := []struct {
+		pathInfo  string
+		act       string
+		keepAlive bool
+	}{
+		{pathInfo: "/rule/browse", act: "ask", keepAlive: true},
+		{pathInfo: "/rule/update", act: "ask", keepAlive: true},
+		{pathInfo: "/monitor/alive", act: "", keepAlive: false},
+	}
+
+	conn := NewHttpConnection(testServerConnection(t, stream))
+	for i, w := range want {
+		request, err := conn.ReadRequest(time.Second)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if request.PathInfo() != w.pathInfo || request.Rstr("act") != w.act || request.IsKeepAlive() != w.keepAlive {
+			t.Errorf("request %d: want %s act=%q keepalive=%v, got %s act=%q keepalive=%v", i,
+				w.pathInfo, w.act, w.keepAlive, request.PathInfo(), request.Rstr("act"), request.IsKeepAlive())
+		}
+	}
+	if _, err := conn.ReadRequest(time.Second); err == nil {
+		t.Errorf("want error after the last request")
+	}
+}
+
+func TestHttpRequestLine(t *testing.T) {
+	cases := []struct {
+		name     string
+		line     string
+		method   string
+		pathInfo string
+		gets     map[string]string
+		bad      bool
+	}{
+		{name: "get", line: "GET /rule/browse?act=ask&uid=1 HTTP/1.1", method: "GET", pathInfo: "/rule/browse", gets: map[string]string{"act": "ask", "uid": "1"}},
+		{name: "head", line: "HEAD /monitor/alive HTTP/1.0", method: "HEAD", pathInfo: "/monitor/alive", gets: map[string]string{}},
+		{name: "absolute uri", line: "GET http://127.0.0.1:9981/rule/browse?act=ask HTTP/1.1", method: "GET", pathInfo: "/rule/browse", gets: map[string]string{"act": "ask"}},
+		{name: "absolute uri without path", line: "OPTIONS HTTPS://koala.local HTTP/1.1", method: "OPTIONS", pathInfo: "/", gets: map[string]string{}},
+		{name: "absolute uri query only", line: "GET http://koala.local?act=ask HTTP/1.1", method: "GET", pathInfo: "/", gets: map[string]string{"act": "ask"}},
+		{name: "escaped query", line: "GET /rule/browse?uid=a%20b HTTP/1.1", method: "GET", pathInfo: "/rule/browse", gets: map[string]string{"uid": "a b"}},
+		{name: "missing version", line: "GET /rule/browse", bad: true},
+		{name: "query without value", line: "GET /rule/browse?act HTTP/1.1", bad: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			request := NewHttpRequest()
+			err := request.parseHairStream([]byte(c.line))
+			if c.bad {
+				if err == nil {
+					t.Fatalf("want error, got path %q", request.PathInfo())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if request.Method() != c.method || request.PathInfo() != c.pathInfo {
+				t.Errorf("want %s %s, got %s %s", c.method, c.pathInfo, request.Method(), request.PathInfo())
+			}
+			if !reflect.DeepEqual(request.Gets(), c.gets) {
+				t.Errorf("gets: want %v, got %v", c.gets, request.Gets())
+			}
+		})
+	}
+}
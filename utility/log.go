@@ -155,6 +155,11 @@ func (l *Logger) syncMsg(logType int, logMsg string) error {
 	// init request log
 	// Log_New()
 
+	// 日志协程未启动（如作为库嵌入使用，未调用 LogRun）时，不记录
+	if GLogV == nil {
+		return nil
+	}
+
 	// 从配置日志级别log_level判断当前日志是否需要入channel队列
 	if (logType & GLogV.LogLevel) != logType {
 		return nil
@@ -768,7 +773,7 @@ func LogDebugPrint(msg string, v interface{}) {
 		fmt.Println(msg)
 	}
 	fmt.Println(v)
-	fmt.Println("=======================Log Debug Info End=======================\n")
+	fmt.Print("=======================Log Debug Info End=======================\n\n")
 }
 
 // LogGetOsSeparator .
@@ -0,0 +1,141 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine redis protocol (RESP) server
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package utility
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrRespProtocol 请求不符合 redis 协议
+var ErrRespProtocol = errors.New("bad resp request")
+
+const (
+	respMaxArgs    = 1 << 16
+	respMaxBulkLen = 1 << 20
+)
+
+// RespConnection redis 协议连接
+// 读、写均带缓冲：客户端 pipeline 发来的多个命令依次读取，回复在 Buffered() 为 0 时统一 Flush
+type RespConnection struct {
+	*TcpConnection
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// NewRespConnection .
+func NewRespConnection(tcpConnection *TcpConnection) *RespConnection {
+	return &RespConnection{TcpConnection: tcpConnection, reader: bufio.NewReader(tcpConnection), writer: bufio.NewWriter(tcpConnection)}
+}
+
+// ReadCommand 读取一条命令；支持 RESP 数组格式与 inline 格式（空格分隔的一行）
+func (c *RespConnection) ReadCommand(timeout time.Duration) ([]string, error) {
+	if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			continue
+		}
+		if line[0] != '*' {
+			if args := strings.Fields(line); len(args) > 0 {
+				return args, nil
+			}
+			continue
+		}
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count > respMaxArgs {
+			return nil, ErrRespProtocol
+		}
+		if count <= 0 {
+			continue
+		}
+		args := make([]string, 0, count)
+		for i := 0; i < count; i++ {
+			arg, err := c.readBulk()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		return args, nil
+	}
+}
+
+func (c *RespConnection) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *RespConnection) readBulk() (string, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return "", err
+	}
+	if line == "" || line[0] != '$' {
+		return "", ErrRespProtocol
+	}
+	size, err := strconv.Atoi(line[1:])
+	if err != nil || size < 0 || size > respMaxBulkLen {
+		return "", ErrRespProtocol
+	}
+	stream := make([]byte, size+2)
+	if _, err := io.ReadFull(c.reader, stream); err != nil {
+		return "", err
+	}
+	return string(stream[:size]), nil
+}
+
+// Buffered 已读入、尚未处理的数据长度；为 0 时说明 pipeline 中的命令已处理完，应 Flush 回复
+func (c *RespConnection) Buffered() int {
+	return c.reader.Buffered()
+}
+
+// WriteStatus 状态回复，如 +OK
+func (c *RespConnection) WriteStatus(status string) {
+	c.writer.WriteString("+" + status + "\r\n")
+}
+
+// WriteError 错误回复；换行替换为空格
+func (c *RespConnection) WriteError(message string) {
+	c.writer.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(message) + "\r\n")
+}
+
+// WriteInteger .
+func (c *RespConnection) WriteInteger(value int64) {
+	c.writer.WriteString(":" + strconv.FormatInt(value, 10) + "\r\n")
+}
+
+// WriteBulk .
+func (c *RespConnection) WriteBulk(value string) {
+	c.writer.WriteString("$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n")
+}
+
+// Flush 发送缓冲中的回复
+func (c *RespConnection) Flush(timeout time.Duration) error {
+	if err := c.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
@@ -0,0 +1,134 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine redis protocol (RESP) tests
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package utility
+
+import (
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+/**
+ * 建立一对本地 tcp 连接：client 写入 stream 后关闭写端，返回服务端一侧的连接
+ */
+func testServerConnection(t *testing.T, stream string) *TcpConnection {
+	listener, err := TcpListen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := TcpConnect("", listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	if _, err := client.Write([]byte(stream)); err != nil {
+		t.Fatal(err)
+	}
+	client.CloseWrite()
+	return server
+}
+
+func TestRespReadCommand(t *testing.T) {
+	cases := []struct {
+		name   string
+		stream string
+		want   [][]string // 依次读出的命令
+		err    error      // 读完 want 之后的错误
+	}{
+		{name: "array", stream: "*2\r\n$4\r\nPING\r\n$3\r\nabc\r\n", want: [][]string{{"PING", "abc"}}, err: io.EOF},
+		{name: "inline", stream: "GET  r501|ask|u1\r\n", want: [][]string{{"GET", "r501|ask|u1"}}, err: io.EOF},
+		{name: "pipeline", stream: "*1\r\n$4\r\nPING\r\nPING\r\n*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$0\r\n\r\n",
+			want: [][]string{{"PING"}, {"PING"}, {"SET", "k", ""}}, err: io.EOF},
+		{name: "binary bulk", stream: "*1\r\n$4\r\na\r\nb\r\n", want: [][]string{{"a\r\nb"}}, err: io.EOF},
+		{name: "blank lines and empty array", stream: "\r\n\r\n*0\r\n*-1\r\n*1\r\n$4\r\nPING\r\n", want: [][]string{{"PING"}}, err: io.EOF},
+		{name: "bad array length", stream: "*x\r\n", err: ErrRespProtocol},
+		{name: "too many args", stream: "*" + strconv.Itoa(respMaxArgs+1) + "\r\n", err: ErrRespProtocol},
+		{name: "missing bulk marker", stream: "*1\r\n:4\r\nPING\r\n", err: ErrRespProtocol},
+		{name: "bad bulk length", stream: "*1\r\n$-1\r\n", err: ErrRespProtocol},
+		{name: "bulk too large", stream: "*1\r\n$" + strconv.Itoa(respMaxBulkLen+1) + "\r\n", err: ErrRespProtocol},
+		{name: "short bulk", stream: "*1\r\n$10\r\nPING\r\n", err: io.ErrUnexpectedEOF},
+		{name: "truncated array", stream: "*2\r\n$4\r\nPING\r\n", err: io.EOF},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn := NewRespConnection(testServerConnection(t, c.stream))
+			got := [][]string{}
+			var err error
+			for {
+				var args []string
+				if args, err = conn.ReadCommand(time.Second); err != nil {
+					break
+				}
+				got = append(got, args)
+			}
+			want := c.want
+			if want == nil {
+				want = [][]string{}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("commands: want %q, got %q", want, got)
+			}
+			if err != c.err {
+				t.Errorf("error: want %v, got %v", c.err, err)
+			}
+		})
+	}
+}
+
+func TestRespWrite(t *testing.T) {
+	listener, err := TcpListen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := TcpConnect("", listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := NewRespConnection(server)
+	conn.WriteStatus("OK")
+	conn.WriteError("ERR bad\r\nrequest")
+	conn.WriteInteger(-2)
+	conn.WriteBulk("a b")
+	if err := conn.Flush(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	stream, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{"+OK", "-ERR bad  request", ":-2", "$3", "a b", ""}, "\r\n")
+	if string(stream) != want {
+		t.Errorf("want %q, got %q", want, stream)
+	}
+}
@@ -96,12 +96,12 @@ func (c *TcpConnection) ReadStream(stream []byte, count int) error {
 
 const protoBufferLen = 8
 
-// ReadProtoBuffer .
+// ReadProtoBuffer 预读连接开头的若干字节，用于判断协议；预读的数据在之后的 Read 中依次返回
 func (c *TcpConnection) ReadProtoBuffer() error {
 	c.protoBuffer = make([]byte, protoBufferLen)
 	left := protoBufferLen
 	for left > 0 {
-		n, err := c.TCPConn.Read(c.protoBuffer)
+		n, err := c.TCPConn.Read(c.protoBuffer[protoBufferLen-left:])
 		if n > 0 {
 			left -= n
 		}
@@ -113,17 +113,21 @@ func (c *TcpConnection) ReadProtoBuffer() error {
 }
 
 // IsHttpProto .
+// 连接开头可能是 http 请求行即视为 http：方法名（大写字母，如 GET、HEAD、PUT、OPTIONS）后跟空格；
+// 预读的字节全为大写字母时（方法名比预读长度长）同样视为 http。gob rpc 流以长度字节开头，不会满足该条件
 func (c *TcpConnection) IsHttpProto() bool {
 	if c.protoBuffer == nil {
 		return false
 	}
-	if c.protoBuffer[0] == 'G' && c.protoBuffer[1] == 'E' && c.protoBuffer[2] == 'T' && c.protoBuffer[3] == ' ' && c.protoBuffer[4] == '/' {
-		return true
-	}
-	if c.protoBuffer[0] == 'P' && c.protoBuffer[1] == 'O' && c.protoBuffer[2] == 'S' && c.protoBuffer[3] == 'T' && c.protoBuffer[4] == ' ' && c.protoBuffer[5] == '/' {
-		return true
+	for i, b := range c.protoBuffer {
+		if b == ' ' {
+			return i > 0
+		}
+		if b < 'A' || b > 'Z' {
+			return false
+		}
 	}
-	return false
+	return true
 }
 
 // Read .
@@ -131,15 +135,10 @@ func (c *TcpConnection) Read(p []byte) (n int, err error) {
 	if c.protoBuffer == nil {
 		n, err = c.TCPConn.Read(p)
 	} else {
-		pLen := len(p)
-		if pLen < protoBufferLen {
-			copy(p, c.protoBuffer[0:pLen])
-			c.protoBuffer = c.protoBuffer[pLen:]
-			n = pLen
-		} else {
-			copy(p, c.protoBuffer)
+		n = copy(p, c.protoBuffer)
+		c.protoBuffer = c.protoBuffer[n:]
+		if len(c.protoBuffer) == 0 {
 			c.protoBuffer = nil
-			n = protoBufferLen
 		}
 	}
 	return
@@ -190,11 +189,67 @@ func (c *TcpConnection) Rpc(request *RpcRequest, readTimeout time.Duration, writ
 	return response, nil
 }
 
+// RpcConnection 长连接上的 rpc 收发
+// 整个连接共用一对 gob 编解码器：类型信息只在首次传输，且解码器预读的数据不会丢失
+type RpcConnection struct {
+	*TcpConnection
+	encoder *gob.Encoder
+	decoder *gob.Decoder
+}
+
+// NewRpcConnection .
+func NewRpcConnection(tcpConnection *TcpConnection) *RpcConnection {
+	return &RpcConnection{TcpConnection: tcpConnection, encoder: gob.NewEncoder(tcpConnection), decoder: gob.NewDecoder(tcpConnection)}
+}
+
+// ReadRequest .
+func (c *RpcConnection) ReadRequest(timeout time.Duration) (*RpcRequest, error) {
+	if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	request := NewRpcRequest()
+	if err := c.decoder.Decode(request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// WriteResponse .
+func (c *RpcConnection) WriteResponse(response *RpcResponse, timeout time.Duration) error {
+	if err := c.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	return c.encoder.Encode(response)
+}
+
+// Call 发送请求并等待响应
+func (c *RpcConnection) Call(request *RpcRequest, readTimeout time.Duration, writeTimeout time.Duration) (*RpcResponse, error) {
+	if err := c.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return nil, err
+	}
+	if err := c.encoder.Encode(request); err != nil {
+		return nil, err
+	}
+	if err := c.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+		return nil, err
+	}
+	response := NewRpcResponse()
+	if err := c.decoder.Decode(response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
 // RegisterRpcTypeForValue 注册 rpc 类型
 func RegisterRpcTypeForValue(value interface{}) {
 	gob.Register(value)
 }
 
+func init() {
+	// multi 类接口的 job 列表，作为 Args 中的值传输
+	RegisterRpcTypeForValue([]map[string]string{})
+}
+
 // RpcRequest .
 type RpcRequest struct {
 	Func string
@@ -0,0 +1,55 @@
+/**
+ * Koala Rule Engine Core
+ *
+ * @package: main
+ * @desc: koala engine tcp protocol sniff tests
+ *
+ * @author: heiyeluren
+ * @github: https://github.com/heiyeluren
+ * @blog: https://blog.csdn.net/heiyeshuwu
+ *
+ */
+
+package utility
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+func TestIsHttpProto(t *testing.T) {
+	var rpcStream bytes.Buffer
+	request := NewRpcRequest()
+	request.Func = "/rule/browse"
+	if err := gob.NewEncoder(&rpcStream).Encode(request); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		stream []byte
+		want   bool
+	}{
+		{name: "get", stream: []byte("GET / HTTP/1.1\r\n"), want: true},
+		{name: "post", stream: []byte("POST /rule/browse HTTP/1.1\r\n"), want: true},
+		{name: "head", stream: []byte("HEAD /monitor/alive HTTP/1.0\r\n"), want: true},
+		{name: "put", stream: []byte("PUT /x HTTP/1.1\r\n"), want: true},
+		{name: "options asterisk", stream: []byte("OPTIONS * HTTP/1.1\r\n"), want: true},
+		{name: "absolute uri", stream: []byte("GET http://koala/ HTTP/1.1\r\n"), want: true},
+		{name: "long method", stream: []byte("PROPFIND / HTTP/1.1\r\n"), want: true},
+		{name: "gob rpc", stream: rpcStream.Bytes(), want: false},
+		{name: "resp", stream: []byte("*1\r\n$4\r\nPING\r\n"), want: false},
+		{name: "lower case", stream: []byte("get / HTTP/1.1\r\n"), want: false},
+		{name: "leading space", stream: []byte(" GET / HTTP/1.1\r\n"), want: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn := &TcpConnection{protoBuffer: c.stream[:protoBufferLen]}
+			if got := conn.IsHttpProto(); got != c.want {
+				t.Errorf("IsHttpProto(%q) = %v, want %v", c.stream[:protoBufferLen], got, c.want)
+			}
+		})
+	}
+}